@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/token"
+)
+
+// retiredClientLifetime is how long clients that were replaced are left
+// connected, for notifications that were already being sent with them,
+// including ones waiting in the push queue.
+const retiredClientLifetime = 5 * time.Minute
+
+// signingKey is where the P8 key for token based authentication comes from,
+// so that it can be read again when the key is rotated.
+type signingKey struct {
+	key     string
+	keyFile string
+	keyID   string
+	teamID  string
+}
+
+// authToken reads the key, from keyFile unless it was given inline, and
+// returns a token signed with it.
+func (k signingKey) authToken() (*token.Token, error) {
+	keyBytes := []byte(k.key)
+	if k.key == "" {
+		var err error
+		if keyBytes, err = ioutil.ReadFile(k.keyFile); err != nil {
+			return nil, errors.New(fmt.Sprintf("Error reading P8_PRIVATE_KEY_FILE: %v", err))
+		}
+	}
+
+	authKey, err := token.AuthKeyFromBytes(keyBytes)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error parsing P8 signing key: %v", err))
+	}
+
+	return &token.Token{AuthKey: authKey, KeyID: k.keyID, TeamID: k.teamID}, nil
+}
+
+// reloadKeyHandler reads the P8 signing key again and switches the relay over
+// to clients that use it. Notifications that are already being sent finish
+// with the previous clients, which are closed a while later.
+func reloadKeyHandler(relay *relayServer, key signingKey, rootCAs *x509.CertPool) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+
+		if request.Method != http.MethodPost {
+			writer.Header().Set("Allow", "POST")
+			writer.WriteHeader(405)
+			fmt.Fprintln(writer, "Keys must be reloaded with POST")
+			return
+		}
+
+		authToken, err := key.authToken()
+		if err == nil {
+			// Signing a token now catches a bad key before it is used.
+			_, err = authToken.Generate()
+		}
+		if err != nil {
+			writer.WriteHeader(500)
+			fmt.Fprintln(writer, "Error reloading signing key:", err)
+			logger.ErrorContext(ctx, "Error reloading signing key", "error", err)
+			return
+		}
+
+		developmentClient := apns2.NewTokenClient(authToken).Development()
+		productionClient := apns2.NewTokenClient(authToken).Production()
+		configureClient(developmentClient, rootCAs)
+		configureClient(productionClient, rootCAs)
+		previous := relay.setClients(clientPair{development: developmentClient, production: productionClient})
+		retireClients(previous)
+
+		logger.InfoContext(ctx, "Reloaded signing key", "key_id", key.keyID)
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(map[string]string{"status": "reloaded", "key_id": key.keyID})
+	}
+}
+
+// retireClients closes the connections of clients once they have had time to
+// finish sending.
+func retireClients(clients clientPair) {
+	for _, client := range []pusher{clients.development, clients.production} {
+		if client, ok := client.(*apns2.Client); ok {
+			time.AfterFunc(retiredClientLifetime, client.CloseIdleConnections)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// p8Key returns a signing key in the PEM encoding of the .p8 files Apple
+// hands out.
+func p8Key(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func TestSigningKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "AuthKey_ABC123DEFG.p8")
+	if err := os.WriteFile(keyFile, []byte(p8Key(t)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []signingKey{
+		{key: p8Key(t), keyID: "ABC123DEFG", teamID: "DEF123GHIJ"},
+		{keyFile: keyFile, keyID: "ABC123DEFG", teamID: "DEF123GHIJ"},
+	} {
+		authToken, err := key.authToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authToken.KeyID != key.keyID || authToken.TeamID != key.teamID {
+			t.Errorf("got key ID %q and team ID %q, want %q and %q", authToken.KeyID, authToken.TeamID, key.keyID, key.teamID)
+		}
+		if _, err := authToken.Generate(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err := (signingKey{keyFile: filepath.Join(t.TempDir(), "missing.p8")}).authToken(); err == nil {
+		t.Error("missing key file was accepted")
+	}
+	if _, err := (signingKey{key: "not a key"}).authToken(); err == nil {
+		t.Error("invalid key was accepted")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/token"
+	"golang.org/x/net/http2"
+)
+
+// appConfig describes the token signing key for one app in APNS_CONFIG_FILE.
+// Apps with a name can also be selected by the push endpoint URL.
+type appConfig struct {
+	Name   string `json:"name"`
+	KeyID  string `json:"key_id"`
+	TeamID string `json:"team_id"`
+	Topic  string `json:"topic"`
+	P8Key  string `json:"p8_key"`
+}
+
+type clientPair struct {
+	development pusher
+	production  pusher
+}
+
+func (pair clientPair) forEnvironment(isProduction bool) pusher {
+	if isProduction {
+		return pair.production
+	}
+	return pair.development
+}
+
+// appTopics maps the names of apps in APNS_CONFIG_FILE to their topics.
+var appTopics = make(map[string]string)
+
+// loadAppConfig creates clients for every app listed in filename, keyed by
+// topic. An app whose key cannot be loaded is logged and skipped, so that it
+// does not take the other apps down with it.
+func loadAppConfig(filename string, rootCAs *x509.CertPool) (map[string]clientPair, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var apps []appConfig
+	if err := json.Unmarshal(data, &apps); err != nil {
+		return nil, err
+	}
+
+	clients := make(map[string]clientPair)
+
+	for _, app := range apps {
+		if app.Topic == "" || app.KeyID == "" || app.TeamID == "" {
+			log.Println("Skipping app with missing topic, key_id or team_id in", filename)
+			continue
+		}
+
+		authKey, err := token.AuthKeyFromBytes([]byte(app.P8Key))
+		if err != nil {
+			log.Printf("Error loading key for %s: %v\n", app.Topic, err)
+			continue
+		}
+
+		authToken := &token.Token{
+			AuthKey: authKey,
+			KeyID:   app.KeyID,
+			TeamID:  app.TeamID,
+		}
+
+		development := apns2.NewTokenClient(authToken).Development()
+		production := apns2.NewTokenClient(authToken).Production()
+		configureClient(development, rootCAs)
+		configureClient(production, rootCAs)
+
+		clients[app.Topic] = clientPair{development: development, production: production}
+		if strings.ContainsAny(app.Name, "/{}") {
+			log.Printf("Not routing relay URLs for %s, as its name %q is not a valid path segment\n", app.Topic, app.Name)
+		} else if app.Name != "" {
+			appTopics[app.Name] = app.Topic
+		}
+		log.Println("Loaded signing key for", app.Topic)
+	}
+
+	return clients, nil
+}
+
+// withApp passes the name of the app a relay URL started with to next as the
+// "app" path value, as app names are part of the routes rather than wildcards.
+func withApp(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		request.SetPathValue("app", name)
+		next(writer, request)
+	}
+}
+
+// configureClient applies the settings shared by all APNs clients: the root CAs
+// from CA_FILENAME, if any, the headers handled by apnsTransport, and counting
+// connections.
+func configureClient(client *apns2.Client, rootCAs *x509.CertPool) {
+	transport := client.HTTPClient.Transport.(*http2.Transport)
+	if rootCAs != nil {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.RootCAs = rootCAs
+	}
+
+	transport.DialTLS = countingDialTLS(transport.DialTLS)
+	client.HTTPClient.Transport = apnsTransport{transport}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/sideshow/apns2"
+	"golang.org/x/net/http2"
+)
+
+func TestConfigureClient(t *testing.T) {
+	defer func(timeout time.Duration) { apns2.HTTPClientTimeout = timeout }(apns2.HTTPClientTimeout)
+	apns2.HTTPClientTimeout = 7 * time.Second
+
+	rootCAs := x509.NewCertPool()
+	client := apns2.NewClient(tls.Certificate{}).Production()
+	configureClient(client, rootCAs)
+
+	if client.HTTPClient.Timeout != 7*time.Second {
+		t.Errorf("got timeout %v, want 7s", client.HTTPClient.Timeout)
+	}
+
+	transport, ok := client.HTTPClient.Transport.(apnsTransport)
+	if !ok {
+		t.Fatalf("got transport %T, want apnsTransport", client.HTTPClient.Transport)
+	}
+	http2Transport, ok := transport.RoundTripper.(*http2.Transport)
+	if !ok {
+		t.Fatalf("got wrapped transport %T, want *http2.Transport", transport.RoundTripper)
+	}
+	if http2Transport.TLSClientConfig.RootCAs != rootCAs {
+		t.Error("root CAs not applied")
+	}
+	if http2Transport.DialTLS == nil {
+		t.Error("got no dial function")
+	}
+
+	// Connections are reused for as long as the client is, so closing them
+	// must still reach the HTTP/2 transport.
+	client.CloseIdleConnections()
+}
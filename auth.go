@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// withBearerToken only lets requests through to next if they carry the header
+// "Authorization: Bearer <token>". Without a token, all requests are let
+// through.
+func withBearerToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	if token == "" {
+		return next
+	}
+
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if !hasBearerToken(request, token) {
+			writer.WriteHeader(401)
+			fmt.Fprintln(writer, "Unauthorized")
+			logger.WarnContext(request.Context(), "Missing or invalid bearer token")
+			return
+		}
+
+		next(writer, request)
+	}
+}
+
+// hasBearerToken compares the bearer token of request with token, in constant
+// time so as not to give away how much of it was right.
+func hasBearerToken(request *http.Request, token string) bool {
+	authorization := request.Header.Get("Authorization")
+	given := strings.TrimPrefix(authorization, "Bearer ")
+	return given != authorization && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithBearerToken(t *testing.T) {
+	tests := []struct {
+		token         string
+		authorization string
+		status        int
+	}{
+		{"secret", "Bearer secret", 200},
+		{"secret", "Bearer wrong", 401},
+		{"secret", "Bearer ", 401},
+		{"secret", "secret", 401},
+		{"secret", "", 401},
+		{"", "", 200},
+		{"", "Bearer anything", 200},
+	}
+
+	for _, test := range tests {
+		handler := withBearerToken(test.token, func(writer http.ResponseWriter, request *http.Request) {})
+
+		request := httptest.NewRequest("POST", "/relay-to/production/"+testDeviceToken, nil)
+		if test.authorization != "" {
+			request.Header.Set("Authorization", test.authorization)
+		}
+		response := httptest.NewRecorder()
+		handler(response, request)
+
+		if response.Code != test.status {
+			t.Errorf("token %q with Authorization %q: got status %d, want %d", test.token, test.authorization, response.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxBatchBodyBytes is the largest batch request accepted, which has room for
+// thousands of device tokens.
+const maxBatchBodyBytes = 1 << 20
+
+var batchConcurrency = 10
+
+type batchRequest struct {
+	Tokens []string `json:"tokens"`
+	Body   string   `json:"body"`
+}
+
+type batchResult struct {
+	Token  string `json:"token"`
+	Status int    `json:"status"`
+	Reason string `json:"reason,omitempty"`
+	ApnsID string `json:"apns_id,omitempty"`
+}
+
+// batchHandler sends the same message to several device tokens. It serves
+// relay URLs without a device token, and the body of the request is a JSON
+// object with the device tokens, and the encrypted message encoded in
+// base64url. The message is relayed to each token as if it had been posted
+// to the URL with that token added, using the headers of the batch request,
+// and the results are returned as a JSON array.
+func (s *relayServer) batchHandler(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+
+	var batch batchRequest
+	err := json.NewDecoder(http.MaxBytesReader(writer, request.Body, maxBatchBodyBytes)).Decode(&batch)
+	if err == nil && len(batch.Tokens) == 0 {
+		err = errors.New("No device tokens given")
+	}
+	var body []byte
+	if err == nil {
+		body, err = decodeBase64URL(batch.Body)
+	}
+	if err != nil {
+		writer.WriteHeader(400)
+		fmt.Fprintln(writer, "Invalid batch request:", err)
+		logger.WarnContext(ctx, "Invalid batch request", "error", err)
+		return
+	}
+
+	requests := make([]*http.Request, len(batch.Tokens))
+	results := make([]batchResult, len(batch.Tokens))
+	for i, deviceToken := range batch.Tokens {
+		single := request.Clone(ctx)
+		single.URL.Path = request.URL.Path + deviceToken
+		single.SetPathValue("token", deviceToken)
+		single.Body = io.NopCloser(bytes.NewReader(body))
+		single.ContentLength = int64(len(body))
+
+		requests[i] = single
+		results[i].Token = deviceToken
+	}
+	s.relayConcurrently(requests, results)
+
+	logger.InfoContext(ctx, "Sent batch", "tokens", len(batch.Tokens))
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(results)
+}
+
+type relayBatchItem struct {
+	Token       string            `json:"token"`
+	Environment string            `json:"environment"`
+	Payload     string            `json:"payload"`
+	Headers     map[string]string `json:"headers"`
+}
+
+// relayBatchHandler sends several different notifications in one request, which
+// is a JSON array of objects with the device token, environment (production by
+// default), encrypted message in base64, and the headers that would have been
+// sent with it. Each is relayed as if it had been posted to its own relay URL,
+// and the results are returned as a JSON array, with invalid items reported
+// there rather than failing the whole batch.
+func (s *relayServer) relayBatchHandler(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", "POST")
+		writer.WriteHeader(405)
+		fmt.Fprintln(writer, "Batches must be sent with POST")
+		return
+	}
+
+	var items []relayBatchItem
+	err := json.NewDecoder(http.MaxBytesReader(writer, request.Body, maxBatchBodyBytes)).Decode(&items)
+	if err == nil && len(items) == 0 {
+		err = errors.New("No notifications given")
+	}
+	if err != nil {
+		writer.WriteHeader(400)
+		fmt.Fprintln(writer, "Invalid batch request:", err)
+		logger.WarnContext(ctx, "Invalid batch request", "error", err)
+		return
+	}
+
+	requests := make([]*http.Request, len(items))
+	results := make([]batchResult, len(items))
+	for i, item := range items {
+		results[i].Token = item.Token
+		single, err := item.request(request)
+		if err != nil {
+			results[i].Status = 400
+			results[i].Reason = err.Error()
+			continue
+		}
+		requests[i] = single
+	}
+	s.relayConcurrently(requests, results)
+
+	logger.InfoContext(ctx, "Sent batch", "notifications", len(items))
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(results)
+}
+
+// request returns the request that would have been made to relay the item on
+// its own.
+func (item relayBatchItem) request(batch *http.Request) (*http.Request, error) {
+	if _, err := normalizeDeviceToken(item.Token); err != nil {
+		return nil, err
+	}
+
+	environment := item.Environment
+	if environment == "" {
+		environment = "production"
+	}
+	if environment != "production" && environment != "development" {
+		return nil, errors.New(fmt.Sprintf("Unknown environment %q", environment))
+	}
+
+	body, err := decodeBase64URL(item.Payload)
+	if err != nil {
+		if body, err = base64.StdEncoding.DecodeString(item.Payload); err != nil {
+			return nil, errors.New("Payload is not valid base64")
+		}
+	}
+
+	single := batch.Clone(batch.Context())
+	single.URL.Path = "/relay-to/" + environment + "/" + item.Token
+	single.SetPathValue("environment", environment)
+	single.SetPathValue("token", item.Token)
+	single.Header = make(http.Header)
+	for name, value := range item.Headers {
+		single.Header.Set(name, value)
+	}
+	single.Body = io.NopCloser(bytes.NewReader(body))
+	single.ContentLength = int64(len(body))
+
+	return single, nil
+}
+
+// relayConcurrently relays each of requests, batchConcurrency at a time,
+// and fills in the status of the corresponding results. Nil requests are
+// skipped.
+func (s *relayServer) relayConcurrently(requests []*http.Request, results []batchResult) {
+	slots := make(chan struct{}, batchConcurrency)
+	var wait sync.WaitGroup
+
+	for i, single := range requests {
+		if single == nil {
+			continue
+		}
+
+		wait.Add(1)
+		slots <- struct{}{}
+		go func(i int, single *http.Request) {
+			defer wait.Done()
+			defer func() { <-slots }()
+
+			ctx, span := startSpan(single.Context(), "relay batch item", "")
+			recorder := &batchRecorder{header: make(http.Header), status: 200}
+			withRecover(s.handler)(recorder, single.WithContext(ctx))
+			span.finish(recorder.status)
+			results[i] = recorder.result(results[i].Token)
+		}(i, single)
+	}
+	wait.Wait()
+}
+
+// batchRecorder captures the response to one of the notifications in a batch.
+type batchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *batchRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *batchRecorder) Write(data []byte) (int, error) {
+	return r.body.Write(data)
+}
+
+func (r *batchRecorder) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *batchRecorder) result(deviceToken string) batchResult {
+	result := batchResult{Token: deviceToken, Status: r.status}
+
+	if r.header.Get("Content-Type") == "application/json" {
+		var response struct {
+			Error  string `json:"error"`
+			ApnsID string `json:"apns_id"`
+		}
+		json.Unmarshal(r.body.Bytes(), &response)
+		result.Reason = response.Error
+		result.ApnsID = response.ApnsID
+	} else if r.status >= 300 {
+		result.Reason = strings.TrimSpace(r.body.String())
+	}
+
+	return result
+}
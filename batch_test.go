@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sideshow/apns2"
+)
+
+// otherDeviceToken is rejected by batchPusher.
+const otherDeviceToken = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func batchPusher() *fakePusher {
+	return &fakePusher{respond: func(notification *apns2.Notification) (*apns2.Response, error) {
+		if notification.DeviceToken == otherDeviceToken {
+			return &apns2.Response{StatusCode: 410, Reason: apns2.ReasonUnregistered}, nil
+		}
+		return &apns2.Response{StatusCode: 200, ApnsID: "8f7e2c1a-4b3d-4e5f-9a8b-7c6d5e4f3a2b"}, nil
+	}}
+}
+
+// postBatch posts body to handler, and returns the status and the results.
+func postBatch(t *testing.T, handler http.HandlerFunc, path string, header map[string]string, body string) (int, []batchResult) {
+	t.Helper()
+	request := httptest.NewRequest("POST", path, strings.NewReader(body))
+	for name, value := range header {
+		request.Header.Set(name, value)
+	}
+	response := httptest.NewRecorder()
+	handler(response, request)
+
+	var results []batchResult
+	if response.Code == 200 {
+		if err := json.Unmarshal(response.Body.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return response.Code, results
+}
+
+func TestBatchHandler(t *testing.T) {
+	pusher := batchPusher()
+	relay := newTestRelay(pusher)
+	body := `{"tokens":["` + testDeviceToken + `","` + otherDeviceToken + `","not-a-token"],"body":"` + base64.RawURLEncoding.EncodeToString([]byte("message")) + `"}`
+
+	status, results := postBatch(t, relay.batchHandler, "/relay-to/production/", aesgcmHeaders(), body)
+	if status != 200 {
+		t.Fatalf("got status %d, want 200", status)
+	}
+
+	want := []int{201, 410, 400}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for i, result := range results {
+		if result.Status != want[i] {
+			t.Errorf("%s: got status %d, want %d", result.Token, result.Status, want[i])
+		}
+	}
+	if results[0].ApnsID == "" || results[1].Reason != apns2.ReasonUnregistered || results[2].Reason == "" {
+		t.Errorf("got results %+v", results)
+	}
+	if len(pusher.pushed()) != 2 {
+		t.Errorf("got %d notifications, want 2", len(pusher.pushed()))
+	}
+
+	for _, invalid := range []string{`{"tokens":[],"body":"bWVzc2FnZQ"}`, `{"tokens":["` + testDeviceToken + `"],"body":"!!!"}`, `not json`} {
+		if status, _ := postBatch(t, relay.batchHandler, "/relay-to/production/", aesgcmHeaders(), invalid); status != 400 {
+			t.Errorf("%s: got status %d, want 400", invalid, status)
+		}
+	}
+}
+
+func TestRelayBatchHandler(t *testing.T) {
+	pusher := &fakePusher{}
+	development := batchPusher()
+	relay := newRelayServer(clientPair{development: development, production: pusher})
+
+	payload := base64.StdEncoding.EncodeToString([]byte("message"))
+	headers, _ := json.Marshal(aesgcmHeaders())
+	item := func(token, environment, payload string, headers []byte) string {
+		return `{"token":"` + token + `","environment":"` + environment + `","payload":"` + payload + `","headers":` + string(headers) + `}`
+	}
+	body := "[" + strings.Join([]string{
+		item(testDeviceToken, "", payload, headers),
+		item(testDeviceToken, "development", payload, headers),
+		item(otherDeviceToken, "development", payload, headers),
+		item("not-a-token", "", payload, headers),
+		item(testDeviceToken, "staging", payload, headers),
+		item(testDeviceToken, "", "!!!", headers),
+		item(testDeviceToken, "", payload, []byte(`{}`)),
+	}, ",") + "]"
+
+	status, results := postBatch(t, relay.relayBatchHandler, "/relay-batch", nil, body)
+	if status != 200 {
+		t.Fatalf("got status %d, want 200", status)
+	}
+
+	want := []int{201, 201, 410, 400, 400, 400, 415}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for i, result := range results {
+		if result.Status != want[i] {
+			t.Errorf("item %d: got status %d, want %d: %s", i, result.Status, want[i], result.Reason)
+		}
+	}
+	if len(pusher.pushed()) != 1 || len(development.pushed()) != 2 {
+		t.Errorf("got %d production and %d development notifications, want 1 and 2", len(pusher.pushed()), len(development.pushed()))
+	}
+
+	if status, _ := postBatch(t, relay.relayBatchHandler, "/relay-batch", nil, "[]"); status != 400 {
+		t.Errorf("empty batch: got status %d, want 400", status)
+	}
+
+	response := httptest.NewRecorder()
+	relay.relayBatchHandler(response, httptest.NewRequest("GET", "/relay-batch", nil))
+	if response.Code != 405 || len(pusher.pushed()) != 1 {
+		t.Errorf("GET: got status %d, want 405 without pushing", response.Code)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+// errCircuitOpen is returned by send when the circuit breaker is open, and the
+// notification was not sent.
+var errCircuitOpen = errors.New("APNs is unavailable, not sending notifications for now")
+
+// breakerWindow is how close together the failures that open the circuit
+// breaker must be.
+const breakerWindow = time.Minute
+
+// circuitBreaker is closed while notifications are sent normally. After
+// threshold failures within breakerWindow it opens, and refuses to send any
+// for timeout. It is then half-open, letting a single notification through,
+// and closes again if that one succeeds. A threshold of 0 disables it.
+type circuitBreaker struct {
+	threshold int
+	timeout   time.Duration
+
+	mutex        sync.Mutex
+	state        string
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	probing      bool
+}
+
+// newCircuitBreaker returns a closed circuit breaker, which stops sending
+// notifications for a while once sending them keeps failing, rather than
+// having every request wait for APNs to time out.
+func newCircuitBreaker(threshold int, timeout time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, timeout: timeout, state: "closed"}
+}
+
+// allow reports whether a notification may be sent now, and if not, how long
+// until one may be tried again. Every notification allowed must have its
+// outcome passed to record.
+func (b *circuitBreaker) allow(ctx context.Context) (bool, time.Duration) {
+	if b.threshold <= 0 {
+		return true, 0
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == "open" {
+		if wait := b.timeout - time.Since(b.openedAt); wait > 0 {
+			return false, wait
+		}
+		b.setState(ctx, "half-open")
+	}
+
+	if b.state == "half-open" {
+		if b.probing {
+			return false, time.Second
+		}
+		b.probing = true
+	}
+
+	return true, 0
+}
+
+// record takes the outcome of a notification that allow let through.
+func (b *circuitBreaker) record(ctx context.Context, failed bool) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == "half-open" {
+		b.probing = false
+		if failed {
+			b.openedAt = time.Now()
+			b.setState(ctx, "open")
+		} else {
+			b.failures = 0
+			b.setState(ctx, "closed")
+		}
+		return
+	}
+
+	if !failed {
+		b.failures = 0
+		return
+	}
+
+	if b.failures == 0 || time.Since(b.firstFailure) > breakerWindow {
+		b.failures = 0
+		b.firstFailure = time.Now()
+	}
+	b.failures++
+
+	if b.state == "closed" && b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.setState(ctx, "open")
+	}
+}
+
+// isOutage reports whether a push failed because APNs is unavailable, which is
+// what the circuit breaker counts: a network error, an attempt timing out, or
+// a server error. Pushes given up on because the request to the relay was
+// cancelled or timed out, or because the notification expired, say nothing
+// about APNs.
+func isOutage(ctx context.Context, res *apns2.Response, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || err == errNotificationExpired {
+		return false
+	}
+	if err != nil {
+		var netErr net.Error
+		return errors.As(err, &netErr)
+	}
+
+	return res.StatusCode >= 500
+}
+
+func (b *circuitBreaker) setState(ctx context.Context, state string) {
+	b.state = state
+	switch state {
+	case "open":
+		logger.WarnContext(ctx, "Circuit breaker opened, not sending notifications", "failures", b.failures, "timeout_ms", b.timeout.Milliseconds())
+	default:
+		logger.InfoContext(ctx, "Circuit breaker "+state)
+	}
+}
+
+// currentState returns "closed", "open" or "half-open".
+func (b *circuitBreaker) currentState() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// An open breaker only becomes half-open once a notification is allowed,
+	// so report it as such as soon as one would be.
+	if b.state == "open" && time.Since(b.openedAt) >= b.timeout {
+		return "half-open"
+	}
+	return b.state
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	b := newCircuitBreaker(3, 20*time.Millisecond)
+
+	// Failures have to be consecutive.
+	for _, failed := range []bool{true, true, false, true, true} {
+		if allowed, _ := b.allow(ctx); !allowed {
+			t.Fatal("closed breaker refused a notification")
+		}
+		b.record(ctx, failed)
+	}
+	if state := b.currentState(); state != "closed" {
+		t.Fatalf("got state %s after interrupted failures, want closed", state)
+	}
+
+	b.allow(ctx)
+	b.record(ctx, true)
+	if state := b.currentState(); state != "open" {
+		t.Fatalf("got state %s after 3 failures, want open", state)
+	}
+	if allowed, wait := b.allow(ctx); allowed || wait <= 0 || wait > b.timeout {
+		t.Fatalf("open breaker gave %v, %v", allowed, wait)
+	}
+
+	time.Sleep(b.timeout)
+	if state := b.currentState(); state != "half-open" {
+		t.Fatalf("got state %s after the timeout, want half-open", state)
+	}
+
+	// Only one notification is let through to probe APNs, and if it fails,
+	// the breaker opens again.
+	if allowed, _ := b.allow(ctx); !allowed {
+		t.Fatal("half-open breaker refused the probe")
+	}
+	if allowed, _ := b.allow(ctx); allowed {
+		t.Fatal("half-open breaker let a second notification through")
+	}
+	b.record(ctx, true)
+	if state := b.currentState(); state != "open" {
+		t.Fatalf("got state %s after a failed probe, want open", state)
+	}
+
+	time.Sleep(b.timeout)
+	b.allow(ctx)
+	b.record(ctx, false)
+	if state := b.currentState(); state != "closed" {
+		t.Fatalf("got state %s after a successful probe, want closed", state)
+	}
+}
+
+func TestCircuitBreakerWindow(t *testing.T) {
+	ctx := context.Background()
+	b := newCircuitBreaker(2, time.Minute)
+
+	b.record(ctx, true)
+	b.firstFailure = time.Now().Add(-breakerWindow - time.Second)
+	b.record(ctx, true)
+	if state := b.currentState(); state != "closed" {
+		t.Errorf("got state %s for failures further apart than the window, want closed", state)
+	}
+
+	b.record(ctx, true)
+	if state := b.currentState(); state != "open" {
+		t.Errorf("got state %s for failures within the window, want open", state)
+	}
+}
+
+func TestHandlerCircuitBreaker(t *testing.T) {
+	var attempts int
+	failing := pusherFunc(func(apns2.Context, *apns2.Notification) (*apns2.Response, error) {
+		attempts++
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	})
+	relay := newTestRelay(failing)
+	relay.breaker = newCircuitBreaker(2, 30*time.Second)
+
+	for i := 0; i < 2; i++ {
+		if response := post(relay, relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders())); response.Code != 500 {
+			t.Fatalf("got status %d, want 500", response.Code)
+		}
+	}
+
+	sent := attempts
+	response := post(relay, relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders()))
+	if response.Code != 503 || response.Header().Get("Retry-After") != "30" {
+		t.Errorf("got status %d with Retry-After %q, want 503 with 30", response.Code, response.Header().Get("Retry-After"))
+	}
+	if attempts != sent {
+		t.Error("notification was sent with the breaker open")
+	}
+}
+
+func TestIsOutage(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		res  *apns2.Response
+		err  error
+		want bool
+	}{
+		{"sent", context.Background(), &apns2.Response{StatusCode: 200}, nil, false},
+		{"server error", context.Background(), &apns2.Response{StatusCode: 503}, nil, true},
+		{"rejected", context.Background(), &apns2.Response{StatusCode: 410}, nil, false},
+		{"too many requests", context.Background(), &apns2.Response{StatusCode: 429}, nil, false},
+		{"network error", context.Background(), nil, &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"attempt timed out", context.Background(), nil, &url.Error{Op: "Post", Err: context.DeadlineExceeded}, true},
+		{"cancelled", context.Background(), nil, &url.Error{Op: "Post", Err: context.Canceled}, false},
+		{"request done", cancelled, nil, cancelled.Err(), false},
+		{"expired", context.Background(), &apns2.Response{StatusCode: 503}, errNotificationExpired, false},
+		{"encoding error", context.Background(), nil, errors.New("json: unsupported value"), false},
+	}
+
+	for _, test := range tests {
+		if got := isOutage(test.ctx, test.res, test.err); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHandlerCircuitBreakerCancelled(t *testing.T) {
+	// The sender hangs up while the push is being sent.
+	var hangUp context.CancelFunc
+	hungUp := pusherFunc(func(ctx apns2.Context, notification *apns2.Notification) (*apns2.Response, error) {
+		hangUp()
+		return nil, &url.Error{Op: "Post", Err: ctx.Err()}
+	})
+	relay := newTestRelay(hungUp)
+	relay.breaker = newCircuitBreaker(2, 30*time.Second)
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		hangUp = cancel
+		post(relay, relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders()).WithContext(ctx))
+		cancel()
+	}
+
+	if state := relay.breaker.currentState(); state != "closed" {
+		t.Errorf("got state %s after cancelled requests, want closed", state)
+	}
+}
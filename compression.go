@@ -0,0 +1,34 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+)
+
+// decompressBodies is set by DECOMPRESS_BODIES, to accept bodies compressed
+// after being encrypted. This is opt-in, so that an unexpected coding is never
+// mistaken for part of the encrypted message.
+var decompressBodies = false
+
+// decompressBody undoes gzip or deflate compression listed last in
+// contentEncoding, which lists the codings in the order they were applied, as
+// in "aes128gcm, gzip". It returns the decompressed body and the codings that
+// remain. Other bodies are returned as they are.
+func decompressBody(body io.Reader, contentEncoding string) (io.Reader, string, error) {
+	codings := strings.Split(contentEncoding, ",")
+	last := strings.ToLower(strings.TrimSpace(codings[len(codings)-1]))
+	remaining := strings.TrimSpace(strings.Join(codings[:len(codings)-1], ","))
+
+	switch last {
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(body)
+		return reader, remaining, err
+	case "deflate":
+		reader, err := zlib.NewReader(body)
+		return reader, remaining, err
+	}
+
+	return body, contentEncoding, nil
+}
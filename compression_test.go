@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"testing"
+
+	"github.com/DagAgren/toot-relay/pkg/z85"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(data)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return compressed.Bytes()
+}
+
+func TestDecompressBody(t *testing.T) {
+	var deflated bytes.Buffer
+	writer := zlib.NewWriter(&deflated)
+	writer.Write([]byte("message"))
+	writer.Close()
+
+	tests := []struct {
+		contentEncoding string
+		body            []byte
+		remaining       string
+	}{
+		{"aes128gcm, gzip", gzipped(t, []byte("message")), "aes128gcm"},
+		{"aesgcm,X-GZIP", gzipped(t, []byte("message")), "aesgcm"},
+		{"aes128gcm, deflate", deflated.Bytes(), "aes128gcm"},
+		{"aes128gcm", []byte("message"), "aes128gcm"},
+	}
+
+	for _, test := range tests {
+		body, remaining, err := decompressBody(bytes.NewReader(test.body), test.contentEncoding)
+		if err != nil {
+			t.Fatalf("%s: %v", test.contentEncoding, err)
+		}
+		data, err := io.ReadAll(body)
+		if err != nil || string(data) != "message" || remaining != test.remaining {
+			t.Errorf("%s: got %q and %q, %v, want %q and %q", test.contentEncoding, data, remaining, err, "message", test.remaining)
+		}
+	}
+
+	if _, _, err := decompressBody(bytes.NewReader([]byte("message")), "aesgcm, gzip"); err == nil {
+		t.Error("body that is not gzip was accepted")
+	}
+}
+
+func TestHandlerDecompression(t *testing.T) {
+	defer func(decompress bool) { decompressBodies = decompress }(decompressBodies)
+
+	tests := []struct {
+		decompress bool
+		body       []byte
+		status     int
+	}{
+		{true, gzipped(t, []byte("message")), 201},
+		// Far smaller than the limit compressed, but not decompressed.
+		{true, gzipped(t, make([]byte, maxBodyBytes+1)), 413},
+		{true, []byte("message"), 400},
+		{false, gzipped(t, []byte("message")), 415},
+	}
+
+	for i, test := range tests {
+		decompressBodies = test.decompress
+		header := aesgcmHeaders()
+		header["Content-Encoding"] = "aesgcm, gzip"
+
+		pusher := &fakePusher{}
+		response := post(newTestRelay(pusher), relayRequest(testDeviceToken, test.body, header))
+		if response.Code != test.status {
+			t.Errorf("test %d: got status %d, want %d", i, response.Code, test.status)
+		}
+		if test.status == 201 {
+			if p := payloadFields(t, pusher.pushed()[0])["p"]; p != z85.Encode([]byte("message")) {
+				t.Errorf("test %d: got payload %v, want the decompressed message", i, p)
+			}
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+)
+
+// corsAllowHeaders lists the request headers understood by the push endpoint,
+// so that browsers will allow them to be sent.
+const corsAllowHeaders = "Content-Encoding,Content-Type,TTL,Urgency,Topic,Authorization,Encryption,Crypto-Key,Alert,Badge,Sound,Thread-Id,Topic-Bundle,X-Dry-Run,X-Request-ID,traceparent"
+
+// withCORS allows browsers to GET and POST to next from pages on allowOrigin, which
+// may be "*" to allow any origin. Preflight OPTIONS requests are answered
+// directly.
+func withCORS(allowOrigin string, next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+		writer.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+		writer.Header().Set("Access-Control-Expose-Headers", "Location,Retry-After,X-Request-ID,X-Token-Status")
+
+		if request.Method == http.MethodOptions {
+			writer.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
+			writer.WriteHeader(204)
+			return
+		}
+
+		next(writer, request)
+	}
+}
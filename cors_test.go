@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithCORSPreflight(t *testing.T) {
+	called := false
+	handler := withCORS("https://client.example", func(writer http.ResponseWriter, request *http.Request) {
+		called = true
+	})
+
+	request := httptest.NewRequest("OPTIONS", "/relay-to/production/"+testDeviceToken, nil)
+	request.Header.Set("Origin", "https://client.example")
+	request.Header.Set("Access-Control-Request-Method", "POST")
+	response := httptest.NewRecorder()
+	handler(response, request)
+
+	if response.Code != 204 {
+		t.Errorf("got status %d, want 204", response.Code)
+	}
+	if called {
+		t.Error("preflight request passed on")
+	}
+
+	want := map[string]string{
+		"Access-Control-Allow-Origin":  "https://client.example",
+		"Access-Control-Allow-Methods": "GET,POST,OPTIONS",
+	}
+	for name, value := range want {
+		if got := response.Header().Get(name); got != value {
+			t.Errorf("got %s %q, want %q", name, got, value)
+		}
+	}
+	for _, name := range []string{"Content-Encoding", "Crypto-Key", "Encryption", "TTL", "Urgency"} {
+		if !strings.Contains(response.Header().Get("Access-Control-Allow-Headers"), name) {
+			t.Errorf("%s not allowed", name)
+		}
+	}
+}
+
+func TestWithCORSPost(t *testing.T) {
+	mux := newTestMux(newTestRelay(&fakePusher{}))
+	request := relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders())
+	request.Header.Set("Origin", "https://client.example")
+	response := serve(mux, request)
+
+	if response.Code != 201 {
+		t.Errorf("got status %d, want 201", response.Code)
+	}
+	if origin := response.Header().Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Errorf("got Access-Control-Allow-Origin %q, want *", origin)
+	}
+	if exposed := response.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(exposed, "Location") {
+		t.Errorf("Location not exposed in %q", exposed)
+	}
+}
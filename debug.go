@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/DagAgren/toot-relay/pkg/z85"
+)
+
+// encodeHandler answers with the fields handler would add to the payload for
+// the message in the request body and its encryption headers, without pushing
+// anything, so that client developers can check their decoder against them.
+func encodeHandler(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", "POST")
+		writer.WriteHeader(405)
+		fmt.Fprintln(writer, "Messages must be sent with POST")
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(writer, request.Body, int64(maxBodyBytes))
+	contentEncoding := request.Header.Get("Content-Encoding")
+	var err error
+	if decompressBodies {
+		var decompressed io.Reader
+		if decompressed, contentEncoding, err = decompressBody(body, contentEncoding); err != nil {
+			writer.WriteHeader(400)
+			fmt.Fprintln(writer, "Error decompressing request body:", err)
+			return
+		}
+		if decompressed != body {
+			// The decompressed message must fit the limit too, as for handler.
+			body = http.MaxBytesReader(writer, io.NopCloser(decompressed), int64(maxBodyBytes))
+		}
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writer.WriteHeader(413)
+			fmt.Fprintln(writer, "Request body larger than", maxBodyBytes, "bytes")
+		} else {
+			writer.WriteHeader(400)
+			fmt.Fprintln(writer, "Error reading request body:", err)
+		}
+		return
+	}
+
+	fields := map[string]string{"p": z85.Encode(data)}
+	switch contentEncoding {
+	case "aesgcm":
+		if err := checkEncryptionHeaders(request.Header); err != nil {
+			writer.WriteHeader(400)
+			fmt.Fprintln(writer, err)
+			return
+		}
+
+		// Missing values are reported rather than refused, as the point is
+		// to show what was understood.
+		if publicKey, err := encodedValue(request.Header, "Crypto-Key", "dh"); err == nil {
+			fields["k"] = publicKey
+		} else {
+			fields["k_error"] = err.Error()
+		}
+		if salt, err := encodedValue(request.Header, "Encryption", "salt"); err == nil {
+			fields["s"] = salt
+		} else {
+			fields["s_error"] = err.Error()
+		}
+	case "aes128gcm":
+		salt, publicKey, ciphertext, err := parseAES128GCMHeader(data)
+		if err != nil {
+			writer.WriteHeader(400)
+			fmt.Fprintln(writer, "Error parsing aes128gcm header:", err)
+			return
+		}
+
+		fields["p"] = z85.Encode(ciphertext)
+		fields["as"] = z85.Encode(salt)
+		fields["ak"] = z85.Encode(publicKey)
+		fields["e"] = "aes128gcm"
+	default:
+		writer.WriteHeader(415)
+		fmt.Fprintln(writer, "Unsupported Content-Encoding:", request.Header.Get("Content-Encoding"))
+		return
+	}
+
+	if forwardVAPID {
+		for name, value := range vapidFields(request) {
+			fields[name] = value
+		}
+	}
+
+	logger.DebugContext(ctx, "Encoded message for debugging", "bytes", len(data))
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(fields)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/DagAgren/toot-relay/pkg/z85"
+)
+
+// encode posts body with header to encodeHandler, and returns the status and
+// the fields answered with.
+func encode(t *testing.T, method string, body []byte, header map[string]string) (int, map[string]string) {
+	t.Helper()
+	request := httptest.NewRequest(method, "/encode", bytes.NewReader(body))
+	for name, value := range header {
+		request.Header.Set(name, value)
+	}
+	response := httptest.NewRecorder()
+	encodeHandler(response, request)
+
+	var fields map[string]string
+	if response.Code == 200 {
+		if err := json.Unmarshal(response.Body.Bytes(), &fields); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return response.Code, fields
+}
+
+func TestEncodeHandler(t *testing.T) {
+	status, fields := encode(t, "POST", []byte("message"), aesgcmHeaders())
+	want := map[string]string{
+		"p": z85.Encode([]byte("message")),
+		"k": z85.Encode(bytes.Repeat([]byte{4}, 65)),
+		"s": z85.Encode(bytes.Repeat([]byte{7}, 16)),
+	}
+	if status != 200 || !reflect.DeepEqual(fields, want) {
+		t.Errorf("aesgcm: got %d %v, want 200 %v", status, fields, want)
+	}
+
+	salt, publicKey, ciphertext := bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{4}, 65), []byte("ciphertext of the message")
+	status, fields = encode(t, "POST", aes128gcmBody(salt, publicKey, ciphertext), map[string]string{"Content-Encoding": "aes128gcm"})
+	want = map[string]string{
+		"p":  z85.Encode(ciphertext),
+		"as": z85.Encode(salt),
+		"ak": z85.Encode(publicKey),
+		"e":  "aes128gcm",
+	}
+	if status != 200 || !reflect.DeepEqual(fields, want) {
+		t.Errorf("aes128gcm: got %d %v, want 200 %v", status, fields, want)
+	}
+}
+
+func TestEncodeHandlerErrors(t *testing.T) {
+	// Missing values are reported rather than refused.
+	header := aesgcmHeaders()
+	delete(header, "Encryption")
+	if status, fields := encode(t, "POST", []byte("message"), header); status != 200 || fields["s_error"] == "" || fields["k"] == "" {
+		t.Errorf("missing salt: got %d %v", status, fields)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		body   []byte
+		header map[string]string
+		status int
+	}{
+		{"GET", "GET", nil, aesgcmHeaders(), 405},
+		{"no Content-Encoding", "POST", []byte("message"), nil, 415},
+		{"short aes128gcm", "POST", []byte("message"), map[string]string{"Content-Encoding": "aes128gcm"}, 400},
+		{"too large", "POST", make([]byte, maxBodyBytes+1), aesgcmHeaders(), 413},
+	}
+
+	for _, test := range tests {
+		if status, _ := encode(t, test.method, test.body, test.header); status != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, status, test.status)
+		}
+	}
+}
+
+func TestEncodeHandlerDecompression(t *testing.T) {
+	defer func(decompress bool) { decompressBodies = decompress }(decompressBodies)
+	decompressBodies = true
+
+	tests := []struct {
+		body   []byte
+		status int
+	}{
+		{gzipped(t, []byte("message")), 200},
+		// Far smaller than the limit compressed, but not decompressed.
+		{gzipped(t, make([]byte, maxBodyBytes+1)), 413},
+	}
+
+	for i, test := range tests {
+		header := aesgcmHeaders()
+		header["Content-Encoding"] = "aesgcm, gzip"
+		status, fields := encode(t, "POST", test.body, header)
+		if status != test.status {
+			t.Errorf("test %d: got status %d, want %d", i, status, test.status)
+		}
+		if test.status == 200 && fields["p"] != z85.Encode([]byte("message")) {
+			t.Errorf("test %d: got %v, want the decompressed message", i, fields["p"])
+		}
+	}
+}
+
+func TestEncodeHandlerMatchesRelay(t *testing.T) {
+	body := aes128gcmBody(bytes.Repeat([]byte{1}, 16), bytes.Repeat([]byte{4}, 65), []byte("ciphertext of the message"))
+	for _, test := range []struct {
+		body   []byte
+		header map[string]string
+	}{
+		{[]byte("message"), aesgcmHeaders()},
+		{body, map[string]string{"Content-Encoding": "aes128gcm"}},
+	} {
+		_, fields := encode(t, "POST", test.body, test.header)
+
+		pusher := &fakePusher{}
+		post(newTestRelay(pusher), relayRequest(testDeviceToken, test.body, test.header))
+		relayed := payloadFields(t, pusher.pushed()[0])
+		for name, value := range fields {
+			if relayed[name] != value {
+				t.Errorf("%s: /encode gave %s %q, but %v was relayed", test.header["Content-Encoding"], name, value, relayed[name])
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+// dedupCache remembers the APNs IDs of up to size recently sent notifications,
+// in least recently used order, so that a server retrying a request that timed
+// out does not make the notification show up twice.
+type dedupCache struct {
+	size int
+
+	mutex sync.Mutex
+	order *list.List
+	byKey map[string]*list.Element
+}
+
+func newDedupCache(size int) *dedupCache {
+	return &dedupCache{size: size, order: list.New(), byKey: make(map[string]*list.Element)}
+}
+
+type sentNotification struct {
+	key        string
+	apnsID     string
+	expiration time.Time
+}
+
+// notificationKey identifies a notification by its device token and payload,
+// which includes the encrypted message, so that the same message sent to
+// several devices is never mistaken for a duplicate.
+func notificationKey(notification *apns2.Notification) string {
+	encoded, _ := json.Marshal(notification.Payload)
+	hash := sha256.Sum256(append([]byte(notification.DeviceToken+"\x00"), encoded...))
+	return hex.EncodeToString(hash[:])
+}
+
+// lookup returns the APNs ID of the notification if it has already been sent,
+// and has not yet expired.
+func (c *dedupCache) lookup(notification *apns2.Notification) (string, bool) {
+	key := notificationKey(notification)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, exists := c.byKey[key]
+	if !exists {
+		return "", false
+	}
+
+	entry := element.Value.(*sentNotification)
+	if time.Now().After(entry.expiration) {
+		c.order.Remove(element)
+		delete(c.byKey, key)
+		return "", false
+	}
+
+	c.order.MoveToFront(element)
+	return entry.apnsID, true
+}
+
+// remember records that a notification was sent, until it expires.
+// Notifications without a TTL are not remembered, as there is no telling for
+// how long a retry would still be a duplicate.
+func (c *dedupCache) remember(notification *apns2.Notification, apnsID string) {
+	if notification.Expiration.IsZero() {
+		return
+	}
+
+	key := notificationKey(notification)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, exists := c.byKey[key]; exists {
+		c.order.Remove(element)
+	}
+
+	entry := &sentNotification{key: key, apnsID: apnsID, expiration: notification.Expiration}
+	c.byKey[key] = c.order.PushFront(entry)
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.byKey, oldest.Value.(*sentNotification).key)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/payload"
+)
+
+func testNotification(message string, expiration time.Time) *apns2.Notification {
+	return &apns2.Notification{
+		DeviceToken: testDeviceToken,
+		Payload:     payload.NewPayload().Custom("p", message),
+		Expiration:  expiration,
+	}
+}
+
+func TestDedupEviction(t *testing.T) {
+	cache := newDedupCache(2)
+	expiration := time.Now().Add(time.Hour)
+
+	cache.remember(testNotification("a", expiration), "apns-a")
+	cache.remember(testNotification("b", expiration), "apns-b")
+	// Looking a up makes b the least recently used.
+	if id, sent := cache.lookup(testNotification("a", expiration)); !sent || id != "apns-a" {
+		t.Errorf("got %q, %v, want apns-a", id, sent)
+	}
+	cache.remember(testNotification("c", expiration), "apns-c")
+
+	for message, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, sent := cache.lookup(testNotification(message, expiration)); sent != want {
+			t.Errorf("%s: got sent %v, want %v", message, sent, want)
+		}
+	}
+	if cache.order.Len() != 2 {
+		t.Errorf("got %d notifications, want 2", cache.order.Len())
+	}
+}
+
+func TestDedupExpiration(t *testing.T) {
+	cache := newDedupCache(10)
+
+	// Notifications without a TTL are never remembered.
+	cache.remember(testNotification("forever", time.Time{}), "apns-forever")
+	if _, sent := cache.lookup(testNotification("forever", time.Time{})); sent {
+		t.Error("remembered a notification without a TTL")
+	}
+
+	cache.remember(testNotification("expired", time.Now().Add(-time.Second)), "apns-expired")
+	if _, sent := cache.lookup(testNotification("expired", time.Now().Add(-time.Second))); sent {
+		t.Error("remembered an expired notification")
+	}
+	if cache.order.Len() != 0 {
+		t.Errorf("got %d notifications, want expired ones forgotten", cache.order.Len())
+	}
+}
+
+func TestNotificationKey(t *testing.T) {
+	notification := testNotification("a", time.Time{})
+	other := testNotification("a", time.Time{})
+	other.DeviceToken = testDeviceToken[:60] + "0000"
+
+	if notificationKey(notification) == notificationKey(other) {
+		t.Error("the same message to another device token has the same key")
+	}
+	if notificationKey(notification) != notificationKey(testNotification("a", time.Now())) {
+		t.Error("the same notification has another key")
+	}
+}
+
+func TestHandlerDuplicate(t *testing.T) {
+	header := aesgcmHeaders()
+	header["TTL"] = "60"
+	pusher := &fakePusher{}
+	relay := newTestRelay(pusher)
+	relay.sent = newDedupCache(10)
+	for i := 0; i < 2; i++ {
+		response := post(relay, relayRequest(testDeviceToken, []byte("message"), header))
+		if response.Code != 201 {
+			t.Errorf("request %d: got status %d, want 201", i+1, response.Code)
+		}
+		if location := response.Header().Get("Location"); location != "urn:uuid:8f7e2c1a-4b3d-4e5f-9a8b-7c6d5e4f3a2b" {
+			t.Errorf("request %d: got Location %q", i+1, location)
+		}
+	}
+
+	if len(pusher.pushed()) != 1 {
+		t.Errorf("got %d notifications, want the duplicate not pushed", len(pusher.pushed()))
+	}
+}
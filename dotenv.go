@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// loadDotEnv sets environment variables from filename, which has one KEY=value
+// per line, for local development. Values may be quoted with " or ', and
+// multiple lines may be enclosed in """. Lines starting with # are comments.
+// Variables that are already set are not overridden. It returns how many keys
+// were found in the file.
+func loadDotEnv(filename string) (int, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+
+	values, err := parseDotEnv(string(data))
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("%s: %v", filename, err))
+	}
+
+	for _, value := range values {
+		if _, isPresent := os.LookupEnv(value[0]); !isPresent {
+			os.Setenv(value[0], value[1])
+		}
+	}
+
+	return len(values), nil
+}
+
+// parseDotEnv returns the keys and values defined in data, in order.
+func parseDotEnv(data string) ([][2]string, error) {
+	var values [][2]string
+
+	lines := strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNumber := i + 1
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, errors.New(fmt.Sprintf("line %d: Expected KEY=value", lineNumber))
+		}
+		value = strings.TrimSpace(value)
+
+		switch {
+		case strings.HasPrefix(value, `"""`):
+			value = value[3:]
+			var valueLines []string
+			for {
+				if end := strings.Index(value, `"""`); end >= 0 {
+					valueLines = append(valueLines, value[:end])
+					break
+				}
+				valueLines = append(valueLines, value)
+
+				i++
+				if i == len(lines) {
+					return nil, errors.New(fmt.Sprintf("line %d: Unterminated \"\"\" value", lineNumber))
+				}
+				value = lines[i]
+			}
+			value = strings.Join(valueLines, "\n")
+			value = strings.TrimPrefix(value, "\n")
+		case strings.HasPrefix(value, `"`):
+			end := closingQuote(value)
+			if end < 0 {
+				return nil, errors.New(fmt.Sprintf("line %d: Unterminated quoted value", lineNumber))
+			}
+			unquoted, err := strconv.Unquote(value[:end+1])
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("line %d: %v", lineNumber, err))
+			}
+			value = unquoted
+		case strings.HasPrefix(value, "'"):
+			end := strings.Index(value[1:], "'")
+			if end < 0 {
+				return nil, errors.New(fmt.Sprintf("line %d: Unterminated quoted value", lineNumber))
+			}
+			value = value[1 : end+1]
+		default:
+			if comment := strings.Index(value, " #"); comment >= 0 {
+				value = strings.TrimSpace(value[:comment])
+			}
+		}
+
+		values = append(values, [2]string{key, value})
+	}
+
+	return values, nil
+}
+
+// closingQuote returns the index of the " that ends the quoted string at the
+// start of value, skipping escaped quotes, or -1 if there is none.
+func closingQuote(value string) int {
+	for i := 1; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+
+	return -1
+}
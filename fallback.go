@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+
+	"github.com/sideshow/apns2"
+)
+
+// fallbackEnvironment is set by APNS_FALLBACK_ENVIRONMENT, to retry
+// notifications whose device token APNs rejects in one environment in the
+// other. Tokens from development builds are rejected by production, and the
+// other way around, so clients that get the environment wrong still work.
+var fallbackEnvironment = false
+
+// fallbackPusher sends notifications with primary, and those rejected with
+// BadDeviceToken once more with fallback.
+type fallbackPusher struct {
+	primary      pusher
+	fallback     pusher
+	fallbackName string
+}
+
+func (p fallbackPusher) Push(notification *apns2.Notification) (*apns2.Response, error) {
+	return p.PushWithContext(context.Background(), notification)
+}
+
+func (p fallbackPusher) PushWithContext(ctx apns2.Context, notification *apns2.Notification) (*apns2.Response, error) {
+	res, err := p.primary.PushWithContext(ctx, notification)
+	if err != nil || res.Reason != apns2.ReasonBadDeviceToken {
+		return res, err
+	}
+
+	res, err = p.fallback.PushWithContext(ctx, notification)
+	if err == nil && res.Sent() {
+		logger.InfoContext(ctx, "Sent through fallback environment", "device_token", redactToken(notification.DeviceToken), "environment", p.fallbackName)
+	}
+
+	return res, err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/sideshow/apns2"
+)
+
+// rejectingPusher returns a fakePusher that rejects every notification for
+// reason.
+func rejectingPusher(reason string) *fakePusher {
+	return &fakePusher{respond: func(*apns2.Notification) (*apns2.Response, error) {
+		return &apns2.Response{StatusCode: 400, Reason: reason}, nil
+	}}
+}
+
+func TestFallbackPusher(t *testing.T) {
+	tests := []struct {
+		name     string
+		primary  *fakePusher
+		fallback bool
+	}{
+		{"sent", &fakePusher{}, false},
+		{"bad device token", rejectingPusher(apns2.ReasonBadDeviceToken), true},
+		{"other rejection", rejectingPusher(apns2.ReasonPayloadEmpty), false},
+		{"error", &fakePusher{respond: func(*apns2.Notification) (*apns2.Response, error) {
+			return nil, errors.New("connection reset")
+		}}, false},
+	}
+
+	for _, test := range tests {
+		fallback := &fakePusher{}
+		p := fallbackPusher{primary: test.primary, fallback: fallback, fallbackName: "development"}
+
+		res, _ := p.PushWithContext(context.Background(), &apns2.Notification{DeviceToken: testDeviceToken})
+		if len(test.primary.pushed()) != 1 {
+			t.Errorf("%s: got %d pushes to the primary environment, want 1", test.name, len(test.primary.pushed()))
+		}
+		if fellBack := len(fallback.pushed()) == 1; fellBack != test.fallback {
+			t.Errorf("%s: got fallback %v, want %v", test.name, fellBack, test.fallback)
+		}
+		if test.fallback && (res == nil || !res.Sent()) {
+			t.Errorf("%s: got response %+v, want the one from the fallback environment", test.name, res)
+		}
+	}
+}
+
+func TestHandlerFallbackEnvironment(t *testing.T) {
+	tests := []struct {
+		fallback          bool
+		status            int
+		developmentPushes int
+	}{
+		{false, 400, 0},
+		{true, 201, 1},
+	}
+
+	defer func(fallback bool) { fallbackEnvironment = fallback }(fallbackEnvironment)
+	for _, test := range tests {
+		fallbackEnvironment = test.fallback
+		production, development := rejectingPusher(apns2.ReasonBadDeviceToken), &fakePusher{}
+		relay := newRelayServer(clientPair{development: development, production: production})
+
+		if response := post(relay, relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders())); response.Code != test.status {
+			t.Errorf("fallback %v: got status %d, want %d", test.fallback, response.Code, test.status)
+		}
+		if len(development.pushed()) != test.developmentPushes {
+			t.Errorf("fallback %v: got %d development pushes, want %d", test.fallback, len(development.pushed()), test.developmentPushes)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/sideshow/apns2"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// fcmEndpoint is the FCM HTTP v1 API URL, with the project ID left to fill in.
+var fcmEndpoint = "https://fcm.googleapis.com/v1/projects/%s/messages:send"
+
+// fcmTokenPattern matches FCM registration tokens, which unlike APNs device
+// tokens are not hex encoded.
+var fcmTokenPattern = regexp.MustCompile(`^[A-Za-z0-9_:-]+$`)
+
+// fcmPusher is set if BACKEND is fcm, in which case it is used for all
+// notifications instead of the APNs clients.
+var fcmPusher *fcmClient
+
+// fcmClient sends notifications to Android devices through Firebase Cloud
+// Messaging. It takes the same notifications as the APNs clients, so that the
+// handler does not need to know which backend is in use.
+type fcmClient struct {
+	httpClient  *http.Client
+	tokenSource oauth2.TokenSource
+	projectID   string
+}
+
+func newFCMClient(credentialsFile, projectID string) (*fcmClient, error) {
+	data, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := google.CredentialsFromJSON(context.Background(), data, "https://www.googleapis.com/auth/firebase.messaging")
+	if err != nil {
+		return nil, err
+	}
+
+	if projectID == "" {
+		projectID = credentials.ProjectID
+	}
+	if projectID == "" {
+		return nil, errors.New("No project ID in credentials file")
+	}
+
+	tokenSource := oauth2.ReuseTokenSource(nil, credentials.TokenSource)
+
+	return &fcmClient{
+		httpClient: &http.Client{
+			Timeout:   apns2.HTTPClientTimeout,
+			Transport: &oauth2.Transport{Source: tokenSource, Base: http.DefaultTransport},
+		},
+		tokenSource: tokenSource,
+		projectID:   projectID,
+	}, nil
+}
+
+type fcmMessage struct {
+	Token   string            `json:"token"`
+	Data    map[string]string `json:"data"`
+	Android fcmAndroidConfig  `json:"android"`
+}
+
+type fcmAndroidConfig struct {
+	Priority    string `json:"priority"`
+	TTL         string `json:"ttl,omitempty"`
+	CollapseKey string `json:"collapse_key,omitempty"`
+}
+
+type fcmError struct {
+	Error struct {
+		Status  string `json:"status"`
+		Details []struct {
+			ErrorCode string `json:"errorCode"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+// Push sends a notification to FCM without a deadline.
+func (c *fcmClient) Push(notification *apns2.Notification) (*apns2.Response, error) {
+	return c.PushWithContext(context.Background(), notification)
+}
+
+// PushWithContext sends a notification to FCM. The custom payload fields, such
+// as the encoded message and keys, become string data fields, while the APNs
+// specific aps dictionary is left out. Rejections are returned as a Response
+// with the FCM error code as the reason, and the message name as the ID.
+func (c *fcmClient) PushWithContext(ctx apns2.Context, notification *apns2.Notification) (*apns2.Response, error) {
+	encoded, err := json.Marshal(notification.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return nil, err
+	}
+
+	message := fcmMessage{
+		Token: notification.DeviceToken,
+		Data:  make(map[string]string),
+		Android: fcmAndroidConfig{
+			Priority:    "HIGH",
+			CollapseKey: notification.CollapseID,
+		},
+	}
+	for key, value := range fields {
+		if text, ok := value.(string); ok {
+			message.Data[key] = text
+		}
+	}
+	if notification.Priority == apns2.PriorityLow {
+		message.Android.Priority = "NORMAL"
+	}
+	if !notification.Expiration.IsZero() {
+		seconds := int64(time.Until(notification.Expiration).Seconds())
+		if seconds < 0 {
+			seconds = 0
+		}
+		message.Android.TTL = fmt.Sprintf("%ds", seconds)
+	}
+
+	body, err := json.Marshal(map[string]fcmMessage{"message": message})
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest("POST", fmt.Sprintf(fcmEndpoint, c.projectID), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if retryAfter, ok := ctx.Value(retryAfterKey).(*time.Duration); ok {
+		if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			*retryAfter = time.Duration(seconds) * time.Second
+		}
+	}
+
+	res := &apns2.Response{StatusCode: response.StatusCode}
+
+	if response.StatusCode == 200 {
+		var sent struct {
+			Name string `json:"name"`
+		}
+		json.NewDecoder(response.Body).Decode(&sent)
+		res.ApnsID = sent.Name
+		return res, nil
+	}
+
+	var rejected fcmError
+	json.NewDecoder(response.Body).Decode(&rejected)
+	res.Reason = rejected.Error.Status
+	for _, detail := range rejected.Error.Details {
+		if detail.ErrorCode != "" {
+			res.Reason = detail.ErrorCode
+		}
+	}
+
+	return res, nil
+}
+
+// checkToken reports whether an access token can be fetched for the service
+// account, which is the FCM equivalent of checking the push certificate.
+func (c *fcmClient) checkToken() error {
+	_, err := c.tokenSource.Token()
+	return err
+}
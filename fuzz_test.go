@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/DagAgren/toot-relay/pkg/z85"
+)
+
+// The seed corpus in testdata/fuzz holds inputs that used to crash or were
+// wrongly accepted.
+
+func FuzzEncode85(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte("HelloWorld"))
+	f.Add([]byte{0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		encoded := z85.Encode(data)
+		if len(encoded) != z85.EncodedLen(len(data)) {
+			t.Fatalf("got %d digits for %d bytes, want %d", len(encoded), len(data), z85.EncodedLen(len(data)))
+		}
+		if len(encoded) != (len(data)*5+3)/4 {
+			t.Fatalf("EncodedLen(%d) = %d, want %d", len(data), len(encoded), (len(data)*5+3)/4)
+		}
+	})
+}
+
+func FuzzParseKeyValues(f *testing.F) {
+	f.Add("dh=BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcx;p256ecdsa=BDd3_hVL9fZi9Ybo2UUzA284WG5FZR30")
+	f.Add(`salt="lngarbyKfMoi9Z75xYXmkg=="`)
+
+	f.Fuzz(func(t *testing.T, values string) {
+		m := parseKeyValues(values)
+		if len(m) > strings.Count(values, "=") {
+			t.Fatalf("got %d keys from %d separators", len(m), strings.Count(values, "="))
+		}
+		for key := range m {
+			if key != strings.TrimSpace(key) || strings.Contains(key, ";") {
+				t.Fatalf("got key %q", key)
+			}
+		}
+	})
+}
+
+func FuzzEncodedValue(f *testing.F) {
+	f.Add("dh=BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcx")
+	f.Add("dh=BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcx==")
+
+	f.Fuzz(func(t *testing.T, value string) {
+		header := http.Header{"Crypto-Key": {value}}
+		encoded, err := encodedValue(header, "Crypto-Key", "dh")
+		if err != nil {
+			return
+		}
+		if decoded, err := z85.Decode(encoded); err != nil || len(decoded) == 0 {
+			t.Fatalf("got %q, which does not decode to a value: %v", encoded, err)
+		}
+	})
+}
+
+func FuzzHandlerBody(f *testing.F) {
+	f.Add("aesgcm", []byte("message"))
+	f.Add("aes128gcm", make([]byte, 86+16))
+	f.Add("gzip", []byte{0x1f, 0x8b})
+
+	f.Fuzz(func(t *testing.T, contentEncoding string, body []byte) {
+		header := aesgcmHeaders()
+		header["Content-Encoding"] = contentEncoding
+
+		// Only statuses for invalid requests or successful pushes are
+		// expected, never 500 or a panic.
+		switch response := post(newTestRelay(&fakePusher{}), relayRequest(testDeviceToken, body, header)); response.Code {
+		case 201, 400, 413, 415:
+		default:
+			t.Fatalf("got status %d: %s", response.Code, response.Body)
+		}
+	})
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sideshow/apns2"
+	"github.com/sideshow/apns2/payload"
+)
+
+// healthzHandler reports whether the service can actually deliver notifications,
+// as opposed to merely being up. It always checks that the push certificate is
+// within its validity period, or that a token can be signed with the P8 key.
+// If pushCheck is set, it also sends a silent push to canaryToken, which will
+// need to be a real device token for the app. With the FCM backend, it only
+// checks that an access token can be fetched.
+func healthzHandler(productionClient func() *apns2.Client, pushCheck bool, canaryToken string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+
+		var err error
+		production := productionClient()
+		if fcmPusher != nil {
+			err = fcmPusher.checkToken()
+		} else if production == nil {
+			// A dry run without credentials has nothing to check.
+		} else {
+			err = checkCertificate(production)
+			if err == nil && pushCheck {
+				err = checkPush(production, canaryToken)
+			}
+		}
+
+		if failures := authFailures.Load(); err == nil && authFailureThreshold > 0 && failures >= authFailureThreshold {
+			err = errors.New(fmt.Sprintf("APNs rejected the credentials for the last %d notifications", failures))
+		}
+
+		if err != nil {
+			writer.WriteHeader(503)
+			json.NewEncoder(writer).Encode(map[string]string{"apns": "error", "error": err.Error()})
+			logger.WarnContext(request.Context(), "Health check failed", "error", err)
+			return
+		}
+
+		json.NewEncoder(writer).Encode(map[string]string{"apns": "ok"})
+	}
+}
+
+// authFailureReasons are the rejections that mean APNs did not accept our
+// credentials, such as when the signing key has been revoked.
+var authFailureReasons = map[string]bool{
+	apns2.ReasonExpiredProviderToken: true,
+	apns2.ReasonInvalidProviderToken: true,
+	apns2.ReasonMissingProviderToken: true,
+}
+
+var (
+	// authFailures counts the notifications in a row that APNs rejected for
+	// one of authFailureReasons.
+	authFailures atomic.Int64
+
+	// authFailureThreshold is how many of those make /healthz fail, or 0 to
+	// never fail it for them.
+	authFailureThreshold int64
+)
+
+// recordAuthResult keeps track of consecutive authentication failures, given
+// the reason APNs responded with. Any other response means that APNs accepted
+// the credentials.
+func recordAuthResult(ctx context.Context, reason string) {
+	if !authFailureReasons[reason] {
+		authFailures.Store(0)
+		return
+	}
+
+	apnsAuthFailuresTotal.inc(reason)
+	if failures := authFailures.Add(1); failures == authFailureThreshold {
+		logger.ErrorContext(ctx, "APNs keeps rejecting our credentials", "reason", reason, "failures", failures)
+	}
+}
+
+func checkCertificate(client *apns2.Client) error {
+	if client.Token != nil {
+		_, err := client.Token.Generate()
+		return err
+	}
+
+	leaf := client.Certificate.Leaf
+	if leaf == nil {
+		return errors.New("No push certificate loaded")
+	}
+
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return errors.New(fmt.Sprintf("Push certificate not valid until %v", leaf.NotBefore))
+	}
+	if now.After(leaf.NotAfter) {
+		return errors.New(fmt.Sprintf("Push certificate expired at %v", leaf.NotAfter))
+	}
+
+	return nil
+}
+
+func checkPush(client *apns2.Client, canaryToken string) error {
+	notification := &apns2.Notification{
+		DeviceToken: canaryToken,
+		Topic:       topic,
+		Priority:    apns2.PriorityLow,
+		Payload:     payload.NewPayload().ContentAvailable(),
+	}
+
+	res, err := client.Push(notification)
+	if err != nil {
+		return err
+	}
+
+	if !res.Sent() {
+		return errors.New(fmt.Sprintf("Canary push failed: %v %v", res.StatusCode, res.Reason))
+	}
+
+	return nil
+}
+
+// startTime is when the service started, for reporting uptime.
+var startTime = time.Now()
+
+// healthHandler probes whether APNs is reachable, and reports the result
+// along with the uptime of the service. Probes are cached for cacheFor, to
+// avoid sending a push for every probe from a load balancer.
+func healthHandler(productionClient func() *apns2.Client, cacheFor time.Duration) http.HandlerFunc {
+	var mutex sync.Mutex
+	var checkedAt time.Time
+	var lastErr error
+
+	return func(writer http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		if time.Since(checkedAt) > cacheFor {
+			lastErr = probeBackend(productionClient())
+			checkedAt = time.Now()
+		}
+		err := lastErr
+		mutex.Unlock()
+
+		writer.Header().Set("Content-Type", "application/json")
+		uptime := int64(time.Since(startTime).Seconds())
+
+		if err != nil {
+			writer.WriteHeader(503)
+			json.NewEncoder(writer).Encode(map[string]interface{}{
+				"status": "degraded", "apns": "unreachable", "error": err.Error(), "uptime_seconds": uptime,
+			})
+			return
+		}
+
+		json.NewEncoder(writer).Encode(map[string]interface{}{
+			"status": "ok", "apns": "reachable", "uptime_seconds": uptime,
+		})
+	}
+}
+
+// probeBackend checks that notifications can be sent, using probeAPNs with the
+// production client, or by fetching an access token with the FCM backend. A
+// dry run without APNs credentials has no client and nothing to check.
+func probeBackend(production *apns2.Client) error {
+	if fcmPusher != nil {
+		return fcmPusher.checkToken()
+	}
+	if production == nil {
+		return nil
+	}
+
+	return probeAPNs(production)
+}
+
+// probeAPNs pushes to a device token that can not exist. APNs rejecting it as
+// BadDeviceToken proves both that it is reachable and that it accepted our
+// credentials.
+func probeAPNs(client *apns2.Client) error {
+	notification := &apns2.Notification{
+		DeviceToken: strings.Repeat("0", 64),
+		Topic:       topic,
+		Priority:    apns2.PriorityLow,
+		Payload:     payload.NewPayload().ContentAvailable(),
+	}
+
+	res, err := client.Push(notification)
+	if err != nil {
+		return err
+	}
+
+	if res.Reason != apns2.ReasonBadDeviceToken {
+		return errors.New(fmt.Sprintf("Unexpected APNs response: %v %v", res.StatusCode, res.Reason))
+	}
+
+	return nil
+}
+
+var (
+	// ready is set once probeBackend has first succeeded.
+	ready atomic.Bool
+
+	// draining is set when the service has been asked to shut down, so that
+	// /readyz stops load balancers from sending it new requests. shuttingDown
+	// is set once it actually stops accepting them, which fails /livez too.
+	draining     atomic.Bool
+	shuttingDown atomic.Bool
+)
+
+// waitUntilReady probes the backend every interval until it succeeds, and then
+// marks the service as ready.
+func waitUntilReady(production *apns2.Client, interval time.Duration) {
+	for {
+		err := probeBackend(production)
+		if err == nil {
+			ready.Store(true)
+			logger.Info("Backend reachable, ready for requests")
+			return
+		}
+
+		logger.Warn("Backend not reachable yet", "error", err)
+		time.Sleep(interval)
+	}
+}
+
+// probeMethods only lets GET and HEAD requests through to next, as probes do
+// not change anything.
+func probeMethods(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet && request.Method != http.MethodHead {
+			writer.Header().Set("Allow", "GET, HEAD")
+			writer.WriteHeader(405)
+			return
+		}
+
+		next(writer, request)
+	}
+}
+
+// livezHandler reports whether the service is alive, which it is until it
+// shuts down.
+func livezHandler(writer http.ResponseWriter, request *http.Request) {
+	writeProbeStatus(writer, !shuttingDown.Load(), "shutting_down")
+}
+
+// readyzHandler reports whether the service should be sent requests. It is not
+// ready until the backend has been reached, while the push queue, if any, is
+// full, or once it has started shutting down.
+func (s *relayServer) readyzHandler(writer http.ResponseWriter, request *http.Request) {
+	switch {
+	case draining.Load():
+		writeProbeStatus(writer, false, "shutting_down")
+	case !ready.Load():
+		writeProbeStatus(writer, false, "starting")
+	case s.queue != nil && s.queue.full():
+		writeProbeStatus(writer, false, "queue_full")
+	default:
+		writeProbeStatus(writer, true, "")
+	}
+}
+
+func writeProbeStatus(writer http.ResponseWriter, ok bool, status string) {
+	writer.Header().Set("Content-Type", "application/json")
+	if ok {
+		status = "ok"
+	} else {
+		writer.WriteHeader(503)
+	}
+
+	json.NewEncoder(writer).Encode(map[string]string{"status": status})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sideshow/apns2"
+)
+
+// probe calls handler, and returns the status code and the status reported.
+func probe(t *testing.T, handler http.HandlerFunc, method string) (int, string) {
+	t.Helper()
+	response := httptest.NewRecorder()
+	handler(response, httptest.NewRequest(method, "/", nil))
+
+	var body map[string]string
+	json.Unmarshal(response.Body.Bytes(), &body)
+	return response.Code, body["status"]
+}
+
+func TestReadyz(t *testing.T) {
+	defer func() {
+		ready.Store(false)
+		draining.Store(false)
+	}()
+
+	tests := []struct {
+		ready, draining, queueFull bool
+		code                       int
+		status                     string
+	}{
+		{false, false, false, 503, "starting"},
+		{true, false, false, 200, "ok"},
+		{true, false, true, 503, "queue_full"},
+		{true, true, false, 503, "shutting_down"},
+		{false, true, false, 503, "shutting_down"},
+	}
+
+	for _, test := range tests {
+		ready.Store(test.ready)
+		draining.Store(test.draining)
+		relay := newTestRelay(&fakePusher{})
+		if test.queueFull {
+			relay.startPushWorkers(1, 0)
+			relay.queue.enqueue(pushJob{})
+		}
+
+		if code, status := probe(t, relay.readyzHandler, "GET"); code != test.code || status != test.status {
+			t.Errorf("ready %v, draining %v, queue full %v: got %d %q, want %d %q", test.ready, test.draining, test.queueFull, code, status, test.code, test.status)
+		}
+	}
+}
+
+func TestLivez(t *testing.T) {
+	defer shuttingDown.Store(false)
+
+	if code, status := probe(t, livezHandler, "GET"); code != 200 || status != "ok" {
+		t.Errorf("got %d %q, want 200 ok", code, status)
+	}
+
+	// Draining alone still leaves the service alive.
+	draining.Store(true)
+	defer draining.Store(false)
+	if code, _ := probe(t, livezHandler, "GET"); code != 200 {
+		t.Errorf("got %d while draining, want 200", code)
+	}
+
+	shuttingDown.Store(true)
+	if code, status := probe(t, livezHandler, "GET"); code != 503 || status != "shutting_down" {
+		t.Errorf("got %d %q, want 503 shutting_down", code, status)
+	}
+}
+
+func TestProbeMethods(t *testing.T) {
+	for _, method := range []string{"GET", "HEAD"} {
+		if code, _ := probe(t, probeMethods(livezHandler), method); code != 200 {
+			t.Errorf("%s: got %d, want 200", method, code)
+		}
+	}
+
+	response := httptest.NewRecorder()
+	probeMethods(livezHandler)(response, httptest.NewRequest("POST", "/livez", nil))
+	if response.Code != 405 || response.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("POST: got %d with Allow %q, want 405 with GET, HEAD", response.Code, response.Header().Get("Allow"))
+	}
+}
+
+func TestHealthzAuthFailures(t *testing.T) {
+	defer func(threshold int64) {
+		authFailureThreshold = threshold
+		authFailures.Store(0)
+	}(authFailureThreshold)
+	authFailureThreshold = 3
+
+	healthz := healthzHandler(func() *apns2.Client { return nil }, false, "")
+	rejecting := rejectingPusher(apns2.ReasonInvalidProviderToken)
+	relay := newTestRelay(rejecting)
+
+	for i := 1; i <= 3; i++ {
+		if code, _ := probe(t, healthz, "GET"); code != 200 {
+			t.Fatalf("got %d after %d failures, want 200", code, i-1)
+		}
+		post(relay, relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders()))
+	}
+	if code, _ := probe(t, healthz, "GET"); code != 503 {
+		t.Errorf("got %d after 3 failures, want 503", code)
+	}
+
+	// Other rejections mean the credentials were accepted.
+	post(newTestRelay(rejectingPusher(apns2.ReasonBadDeviceToken)), relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders()))
+	if code, _ := probe(t, healthz, "GET"); code != 200 {
+		t.Errorf("got %d after a BadDeviceToken, want 200", code)
+	}
+
+	authFailureThreshold = 0
+	for i := 0; i < 5; i++ {
+		post(relay, relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders()))
+	}
+	if code, _ := probe(t, healthz, "GET"); code != 200 {
+		t.Errorf("got %d without a threshold, want 200", code)
+	}
+}
@@ -0,0 +1,260 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+// Device tokens that mockAPNs rejects.
+const (
+	badDeviceToken          = "badbadbadbadbadbadbadbadbadbadbadbadbadbadbadbadbadbadbadbadbad0"
+	unregisteredDeviceToken = "dead0000dead0000dead0000dead0000dead0000dead0000dead0000dead0000"
+)
+
+type apnsRequest struct {
+	deviceToken string
+	header      http.Header
+	payload     map[string]interface{}
+}
+
+// mockAPNs is an HTTP/2 server that answers like APNs, and keeps the
+// notifications sent to it.
+type mockAPNs struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []apnsRequest
+}
+
+func newMockAPNs(t *testing.T) *mockAPNs {
+	mock := &mockAPNs{}
+	mock.Server = httptest.NewUnstartedServer(http.HandlerFunc(mock.serve))
+	mock.EnableHTTP2 = true
+	mock.StartTLS()
+	t.Cleanup(mock.Close)
+	return mock
+}
+
+func (m *mockAPNs) serve(writer http.ResponseWriter, request *http.Request) {
+	deviceToken := strings.TrimPrefix(request.URL.Path, "/3/device/")
+	var payload map[string]interface{}
+	json.NewDecoder(request.Body).Decode(&payload)
+
+	m.mutex.Lock()
+	m.requests = append(m.requests, apnsRequest{deviceToken, request.Header, payload})
+	m.mutex.Unlock()
+
+	writer.Header().Set("apns-id", "8f7e2c1a-4b3d-4e5f-9a8b-7c6d5e4f3a2b")
+	switch {
+	case !strings.HasPrefix(request.Header.Get("authorization"), "bearer "):
+		writer.WriteHeader(403)
+		io.WriteString(writer, `{"reason":"MissingProviderToken"}`)
+	case deviceToken == badDeviceToken:
+		writer.WriteHeader(400)
+		io.WriteString(writer, `{"reason":"BadDeviceToken"}`)
+	case deviceToken == unregisteredDeviceToken:
+		writer.WriteHeader(410)
+		io.WriteString(writer, `{"reason":"Unregistered","timestamp":1700000000000}`)
+	}
+}
+
+func (m *mockAPNs) received() []apnsRequest {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]apnsRequest(nil), m.requests...)
+}
+
+// newIntegrationRelay starts a relay that pushes to mock through a token
+// client, as with a P8 signing key.
+func newIntegrationRelay(t *testing.T, mock *mockAPNs) *httptest.Server {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p8Key := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	authToken, err := (signingKey{key: string(p8Key), keyID: "ABC123DEFG", teamID: "DEF123GHIJ"}).authToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(mock.Certificate())
+	client := apns2.NewTokenClient(authToken)
+	client.Host = mock.URL
+	configureClient(client, rootCAs)
+	t.Cleanup(client.CloseIdleConnections)
+
+	relay := httptest.NewServer(newTestMux(newRelayServer(clientPair{development: client, production: client})))
+	t.Cleanup(relay.Close)
+	return relay
+}
+
+func TestIntegration(t *testing.T) {
+	mock := newMockAPNs(t)
+	relay := newIntegrationRelay(t, mock)
+
+	// An aes128gcm body with a 16 byte salt, a record size of 4096 and a 65
+	// byte key ID.
+	aes128gcm := append(make([]byte, 16), 0, 0, 16, 0, 65)
+	aes128gcm = append(aes128gcm, make([]byte, 65)...)
+	aes128gcm = append(aes128gcm, "ciphertext"...)
+	tests := []struct {
+		name        string
+		method      string
+		deviceToken string
+		body        []byte
+		header      map[string]string
+		status      int
+		pushed      bool
+	}{
+		{"aesgcm", "POST", testDeviceToken, []byte("message"), aesgcmHeaders(), 201, true},
+		{"aes128gcm", "POST", testDeviceToken, aes128gcm, map[string]string{"Content-Encoding": "aes128gcm"}, 201, true},
+		{"bad device token", "POST", badDeviceToken, []byte("message"), aesgcmHeaders(), 400, true},
+		{"unregistered", "POST", unregisteredDeviceToken, []byte("message"), aesgcmHeaders(), 410, true},
+		{"no Content-Encoding", "POST", testDeviceToken, []byte("message"), nil, 415, false},
+		{"GET", "GET", testDeviceToken, nil, nil, 200, false},
+		{"PUT", "PUT", testDeviceToken, []byte("message"), aesgcmHeaders(), 405, false},
+	}
+
+	for _, test := range tests {
+		before := len(mock.received())
+		response := relayTo(t, relay, test.method, test.deviceToken, test.body, test.header)
+
+		if response.StatusCode != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, response.StatusCode, test.status)
+		}
+		if pushed := len(mock.received()) > before; pushed != test.pushed {
+			t.Errorf("%s: got pushed %v, want %v", test.name, pushed, test.pushed)
+		}
+		if test.name == "unregistered" && response.Header.Get("X-Token-Status") != "unregistered" {
+			t.Errorf("%s: got X-Token-Status %q", test.name, response.Header.Get("X-Token-Status"))
+		}
+	}
+
+	// The notifications arrive as the app expects them.
+	received := mock.received()
+	if len(received) < 2 {
+		t.Fatalf("got %d notifications, want at least 2", len(received))
+	}
+	first := received[0]
+	if first.deviceToken != testDeviceToken || first.header.Get("apns-topic") != topic || first.header.Get("apns-push-type") != "alert" {
+		t.Errorf("got notification for %s with headers %v", first.deviceToken, first.header)
+	}
+	for _, field := range []string{"p", "k", "s"} {
+		if _, ok := first.payload[field]; !ok {
+			t.Errorf("aesgcm payload has no %s: %v", field, first.payload)
+		}
+	}
+	if received[1].payload["e"] != "aes128gcm" {
+		t.Errorf("got aes128gcm payload %v", received[1].payload)
+	}
+}
+
+// relayTo sends a request to the production relay URL for deviceToken on
+// relay, and returns the response with its body closed.
+func relayTo(t *testing.T, relay *httptest.Server, method, deviceToken string, body []byte, header map[string]string) *http.Response {
+	t.Helper()
+	request, _ := http.NewRequest(method, relay.URL+"/relay-to/production/"+deviceToken, bytes.NewReader(body))
+	for name, value := range header {
+		request.Header.Set(name, value)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	return response
+}
+
+func TestIntegrationNotificationHeaders(t *testing.T) {
+	mock := newMockAPNs(t)
+	relay := newIntegrationRelay(t, mock)
+
+	// Expirations are checked to the second, a second either side of the
+	// time the request was made.
+	tests := []struct {
+		name       string
+		header     map[string]string
+		collapseID string
+		priority   string
+		expiresIn  int
+	}{
+		{"defaults", nil, "", "10", -1},
+		{"TTL", map[string]string{"TTL": "3600"}, "", "10", 3600},
+		{"TTL of zero", map[string]string{"TTL": "0"}, "", "10", 0},
+		{"TTL beyond the maximum", map[string]string{"TTL": "99999999"}, "", "10", apnsMaxTTL},
+		{"Topic", map[string]string{"Topic": "status-109876"}, "status-109876", "10", -1},
+		{"very-low urgency", map[string]string{"Urgency": "very-low"}, "", "5", -1},
+		{"low urgency", map[string]string{"Urgency": "low"}, "", "5", -1},
+		{"normal urgency", map[string]string{"Urgency": "normal"}, "", "10", -1},
+		{"high urgency", map[string]string{"Urgency": "high"}, "", "10", -1},
+		{"high urgency without an alert", map[string]string{"Urgency": "high", "Alert": `""`}, "", "5", -1},
+	}
+
+	for _, test := range tests {
+		header := aesgcmHeaders()
+		for name, value := range test.header {
+			header[name] = value
+		}
+
+		sentAt := time.Now().Unix()
+		if response := relayTo(t, relay, "POST", testDeviceToken, []byte(test.name), header); response.StatusCode != 201 {
+			t.Errorf("%s: got status %d, want 201", test.name, response.StatusCode)
+			continue
+		}
+		received := mock.received()
+		apnsHeader := received[len(received)-1].header
+
+		if collapseID := apnsHeader.Get("apns-collapse-id"); collapseID != test.collapseID {
+			t.Errorf("%s: got apns-collapse-id %q, want %q", test.name, collapseID, test.collapseID)
+		}
+		if priority := apnsHeader.Get("apns-priority"); priority != test.priority {
+			t.Errorf("%s: got apns-priority %q, want %q", test.name, priority, test.priority)
+		}
+
+		expiration := apnsHeader.Get("apns-expiration")
+		if test.expiresIn < 0 {
+			if expiration != "" {
+				t.Errorf("%s: got apns-expiration %q, want none", test.name, expiration)
+			}
+		} else if expiresAt, err := strconv.ParseInt(expiration, 10, 64); err != nil || expiresAt < sentAt+int64(test.expiresIn)-1 || expiresAt > sentAt+int64(test.expiresIn)+1 {
+			t.Errorf("%s: got apns-expiration %q, want %d seconds after %d", test.name, expiration, test.expiresIn, sentAt)
+		}
+	}
+}
+
+func TestIntegrationNetworkError(t *testing.T) {
+	// The mock is closed before anything is sent to it, so that connections
+	// to APNs are refused.
+	mock := newMockAPNs(t)
+	relay := newIntegrationRelay(t, mock)
+	mock.Close()
+
+	if response := relayTo(t, relay, "POST", testDeviceToken, []byte("message"), aesgcmHeaders()); response.StatusCode != 500 {
+		t.Errorf("got status %d, want 500", response.StatusCode)
+	}
+	if len(mock.received()) != 0 {
+		t.Errorf("got %d notifications, want none", len(mock.received()))
+	}
+}
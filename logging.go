@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/debug"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	retryAfterKey
+	pushTypeKey
+	spanKey
+)
+
+// logger emits one JSON object per line, unless configured otherwise by
+// LOG_FORMAT. Any request ID stored in the context passed to its *Context
+// methods is added to the record as request_id, and the trace and span of a
+// span as trace_id and span_id.
+var logger = slog.New(contextHandler{slog.NewJSONHandler(os.Stderr, nil)})
+
+// newLogger returns a logger that writes to w in format, "json" or "text",
+// and leaves out records below level.
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	options := &slog.HandlerOptions{}
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	options.Level = logLevel
+
+	switch format {
+	case "json":
+		return slog.New(contextHandler{slog.NewJSONHandler(w, options)}), nil
+	case "text":
+		return slog.New(contextHandler{slog.NewTextHandler(w, options)}), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown log format %q", format))
+	}
+}
+
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestID, ok := ctx.Value(requestIDKey).(string); ok {
+		record.AddAttrs(slog.String("request_id", requestID))
+	}
+	if s, ok := ctx.Value(spanKey).(*span); ok {
+		record.AddAttrs(slog.String("trace_id", s.traceID), slog.String("span_id", s.spanID))
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// requestIDPattern limits the request IDs accepted from clients to ones that
+// are safe to log.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// withRequestID attaches the X-Request-ID of every request to its context,
+// generating a random UUID if there is none, and returns it in the response.
+func withRequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		requestID := request.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(requestID) {
+			requestID = newUUID()
+		}
+
+		writer.Header().Set("X-Request-ID", requestID)
+		ctx := context.WithValue(request.Context(), requestIDKey, requestID)
+		next(writer, request.WithContext(ctx))
+	}
+}
+
+// withRecover turns a panic in next into a 500 response, and logs it along with
+// a stack trace, rather than leaving the client with a dropped connection.
+func withRecover(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
+				logger.ErrorContext(request.Context(), "Panic in handler", "error", err, "stack", string(debug.Stack()))
+				writer.WriteHeader(500)
+				fmt.Fprintln(writer, "Internal error")
+			}
+		}()
+
+		next(writer, request)
+	}
+}
+
+func newUUID() string {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+
+	bytes[6] = (bytes[6] & 0x0f) | 0x40
+	bytes[8] = (bytes[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", bytes[0:4], bytes[4:6], bytes[6:8], bytes[8:10], bytes[10:])
+}
+
+// logTokenMode is how device tokens are logged: "full", "redacted" (only the
+// first and last four characters), or "hashed" (a prefix of their SHA-256 hash).
+var logTokenMode = "redacted"
+
+// redactToken shortens or hashes a device token according to logTokenMode, so
+// that full tokens do not end up in logs.
+func redactToken(token string) string {
+	switch logTokenMode {
+	case "full":
+		return token
+	case "hashed":
+		hash := sha256.Sum256([]byte(token))
+		return hex.EncodeToString(hash[:8])
+	}
+
+	if len(token) > 8 {
+		return token[:4] + "..." + token[len(token)-4:]
+	}
+
+	return token
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestJSONLogKeys(t *testing.T) {
+	var output bytes.Buffer
+	log, err := newLogger(&output, "json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest("POST", "/relay-to/production/"+testDeviceToken, nil)
+	request.Header.Set("X-Request-ID", "request-1")
+	withRequestID(func(writer http.ResponseWriter, request *http.Request) {
+		log.With("device_token", redactToken(testDeviceToken)).InfoContext(request.Context(), "Sent notification", "status_code", 200)
+		log.DebugContext(request.Context(), "Not logged at info level")
+	})(httptest.NewRecorder(), request)
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want 1: %s", len(lines), output.String())
+	}
+
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"level":        "INFO",
+		"msg":          "Sent notification",
+		"request_id":   "request-1",
+		"device_token": redactToken(testDeviceToken),
+		"status_code":  float64(200),
+	}
+	for key, value := range want {
+		if record[key] != value {
+			t.Errorf("got %s %v, want %v", key, record[key], value)
+		}
+	}
+	if _, exists := record["time"]; !exists {
+		t.Error("got no time")
+	}
+}
+
+func TestNewLoggerInvalid(t *testing.T) {
+	if _, err := newLogger(&bytes.Buffer{}, "xml", "info"); err == nil {
+		t.Error("got no error for an unknown format")
+	}
+	if _, err := newLogger(&bytes.Buffer{}, "json", "loud"); err == nil {
+		t.Error("got no error for an unknown level")
+	}
+}
+
+func TestTextLog(t *testing.T) {
+	var output bytes.Buffer
+	log, err := newLogger(&output, "text", "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log.Debug("Retrying push", "attempt", 1)
+	if line := output.String(); !strings.Contains(line, `msg="Retrying push"`) || !strings.Contains(line, "attempt=1") {
+		t.Errorf("got %q", line)
+	}
+}
+
+func TestWithRecover(t *testing.T) {
+	response := httptest.NewRecorder()
+	withRecover(func(writer http.ResponseWriter, request *http.Request) {
+		var header map[string]string
+		header["crash"] = "now"
+	})(response, httptest.NewRequest("POST", "/", nil))
+
+	if response.Code != 500 {
+		t.Errorf("got status %d, want 500", response.Code)
+	}
+}
+
+func TestWithRecoverAbort(t *testing.T) {
+	defer func() {
+		if err := recover(); err != http.ErrAbortHandler {
+			t.Errorf("got panic %v, want http.ErrAbortHandler", err)
+		}
+	}()
+
+	withRecover(func(writer http.ResponseWriter, request *http.Request) {
+		panic(http.ErrAbortHandler)
+	})(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+}
+
+func TestRedactToken(t *testing.T) {
+	tests := []struct {
+		mode, token, want string
+	}{
+		{"redacted", testDeviceToken, testDeviceToken[:4] + "..." + testDeviceToken[60:]},
+		{"redacted", "abcd1234", "abcd1234"},
+		{"full", testDeviceToken, testDeviceToken},
+		{"hashed", "token", "3c469e9d6c5875d3"},
+	}
+
+	defer func(mode string) { logTokenMode = mode }(logTokenMode)
+	for _, test := range tests {
+		logTokenMode = test.mode
+		if got := redactToken(test.token); got != test.want {
+			t.Errorf("%s: redactToken(%q) = %q, want %q", test.mode, test.token, got, test.want)
+		}
+	}
+}
+
+func TestWithRequestID(t *testing.T) {
+	tests := []struct {
+		requestID string
+		echoed    bool
+	}{
+		{"request-1", true},
+		{"3f2c9e1a-7b4d-4c8e-9f6a-1b2c3d4e5f60", true},
+		{"", false},
+		{"has spaces", false},
+		{"line\nbreak", false},
+		{strings.Repeat("a", 129), false},
+	}
+
+	uuidPattern := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	for _, test := range tests {
+		var output bytes.Buffer
+		log := slog.New(contextHandler{slog.NewJSONHandler(&output, nil)})
+
+		var seen string
+		handler := withRequestID(func(writer http.ResponseWriter, request *http.Request) {
+			seen, _ = request.Context().Value(requestIDKey).(string)
+			log.InfoContext(request.Context(), "Sent notification")
+		})
+
+		request := httptest.NewRequest("POST", "/relay-to/production/"+strings.Repeat("0", 64), nil)
+		request.Header["X-Request-Id"] = []string{test.requestID}
+		response := httptest.NewRecorder()
+		handler(response, request)
+
+		requestID := response.Header().Get("X-Request-ID")
+		if requestID != seen {
+			t.Errorf("%q: answered with %q, but the context holds %q", test.requestID, requestID, seen)
+		}
+		if test.echoed && requestID != test.requestID {
+			t.Errorf("%q: got %q, want it echoed", test.requestID, requestID)
+		}
+		if !test.echoed && !uuidPattern.MatchString(requestID) {
+			t.Errorf("%q: got %q, want a generated UUID", test.requestID, requestID)
+		}
+
+		var record struct {
+			RequestID string `json:"request_id"`
+		}
+		if err := json.Unmarshal(output.Bytes(), &record); err != nil || record.RequestID != requestID {
+			t.Errorf("%q: logged %s, want request_id %q", test.requestID, output.Bytes(), requestID)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// registry holds the metrics of the process as a whole, such as those of the
+// connections to APNs, which are served at /metrics along with the metrics of
+// the relayServer.
+var registry = prometheus.NewRegistry()
+
+var (
+	apnsAuthFailuresTotal = newCounterVec(registry, "toot_relay_apns_auth_failures_total",
+		"Notifications rejected by APNs because of our credentials, by reason.", "reason")
+	apnsConnectionsTotal = newCounterVec(registry, "toot_relay_apns_connections_total",
+		"Connections to APNs dialed, reused for a push, and closed.", "event")
+)
+
+// relayMetrics are the metrics of the notifications a relayServer sends, kept
+// in a registry of their own.
+type relayMetrics struct {
+	registry        *prometheus.Registry
+	pushTotal       counterVec
+	pushDuration    histogram
+	apnsReasonTotal counterVec
+}
+
+func newRelayMetrics() *relayMetrics {
+	r := prometheus.NewRegistry()
+	return &relayMetrics{
+		registry: r,
+		pushTotal: newCounterVec(r, "toot_relay_push_total",
+			"Notifications relayed to APNs, by result.", "result"),
+		pushDuration: newHistogram(r, "toot_relay_push_duration_seconds",
+			"Time spent waiting for APNs to respond to a push.",
+			[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}),
+		apnsReasonTotal: newCounterVec(r, "toot_relay_apns_reason_total",
+			"Notifications rejected by APNs, by reason.", "reason"),
+	}
+}
+
+type counterVec struct {
+	*prometheus.CounterVec
+}
+
+func newCounterVec(registry *prometheus.Registry, name, help, label string) counterVec {
+	c := counterVec{prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, []string{label})}
+	registry.MustRegister(c)
+	return c
+}
+
+func (c counterVec) inc(labelValue string) {
+	c.WithLabelValues(labelValue).Inc()
+}
+
+// value returns the count for labelValue, or the total for all of them if
+// labelValue is empty.
+func (c counterVec) value(labelValue string) uint64 {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(metrics)
+		close(metrics)
+	}()
+
+	var total uint64
+	for metric := range metrics {
+		var sample dto.Metric
+		metric.Write(&sample)
+		if labelValue == "" || sample.GetLabel()[0].GetValue() == labelValue {
+			total += uint64(sample.GetCounter().GetValue())
+		}
+	}
+	return total
+}
+
+type histogram struct {
+	prometheus.Histogram
+}
+
+func newHistogram(registry *prometheus.Registry, name, help string, buckets []float64) histogram {
+	h := histogram{prometheus.NewHistogram(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets})}
+	registry.MustRegister(h)
+	return h
+}
+
+func (h histogram) observe(value float64) {
+	h.Observe(value)
+}
+
+// metricsHandler serves the metrics of the process and of the server. If token
+// is not empty, requests must carry it as a bearer token.
+func (s *relayServer) metricsHandler(token string) http.HandlerFunc {
+	metrics := promhttp.HandlerFor(prometheus.Gatherers{registry, s.metrics.registry}, promhttp.HandlerOpts{})
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if token != "" {
+			if !hasBearerToken(request, token) {
+				writer.WriteHeader(401)
+				fmt.Fprintln(writer, "Unauthorized")
+				return
+			}
+		}
+
+		metrics.ServeHTTP(writer, request)
+	}
+}
+
+// statsHandler serves a summary of the push counters as JSON, for operators
+// without Prometheus. It is protected by token in the same way as /metrics.
+func (s *relayServer) statsHandler(token string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if token != "" && !hasBearerToken(request, token) {
+			writer.WriteHeader(401)
+			fmt.Fprintln(writer, "Unauthorized")
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		queueDepth := 0
+		if s.queue != nil {
+			queueDepth = len(s.queue.jobs)
+		}
+
+		json.NewEncoder(writer).Encode(map[string]interface{}{
+			"uptime_seconds":  int64(time.Since(startTime).Seconds()),
+			"pushes_total":    s.metrics.pushTotal.value(""),
+			"pushes_sent":     s.metrics.pushTotal.value("sent"),
+			"pushes_failed":   s.metrics.pushTotal.value("failed"),
+			"pushes_error":    s.metrics.pushTotal.value("error"),
+			"queue_depth":     queueDepth,
+			"circuit_breaker": s.breaker.currentState(),
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCounterVecValue(t *testing.T) {
+	counter := counterVec{prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total", Help: "Things counted."}, []string{"reason"})}
+	counter.inc("plain")
+	counter.inc("plain")
+	counter.inc("other")
+
+	tests := []struct {
+		labelValue string
+		want       uint64
+	}{
+		{"plain", 2},
+		{"other", 1},
+		{"missing", 0},
+		{"", 3},
+	}
+
+	for _, test := range tests {
+		if got := counter.value(test.labelValue); got != test.want {
+			t.Errorf("value(%q) = %d, want %d", test.labelValue, got, test.want)
+		}
+	}
+}
+
+// TestMetricsHandlerFormat checks that every sample served belongs to a metric
+// whose HELP and TYPE came before it, as the exposition format requires.
+func TestMetricsHandlerFormat(t *testing.T) {
+	relay := newTestRelay(&fakePusher{})
+	relay.metrics.pushTotal.inc("sent")
+	relay.metrics.pushDuration.observe(0.1)
+	relay.metrics.apnsReasonTotal.inc("BadDeviceToken")
+	apnsConnectionsTotal.inc("dial")
+
+	response := httptest.NewRecorder()
+	relay.metricsHandler("")(response, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := response.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("got Content-Type %q", contentType)
+	}
+
+	help := make(map[string]bool)
+	types := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(response.Body.String(), "\n"), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+			help[fields[2]] = true
+		case strings.HasPrefix(line, "# TYPE "):
+			if !help[fields[2]] {
+				t.Errorf("TYPE before HELP for %s", fields[2])
+			}
+			types[fields[2]] = fields[3]
+		default:
+			name, _, _ := strings.Cut(fields[0], "{")
+			if types[name] == "" {
+				for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+					if family := strings.TrimSuffix(name, suffix); family != name && types[family] == "histogram" {
+						name = family
+					}
+				}
+			}
+			if types[name] == "" {
+				t.Errorf("sample without TYPE: %s", line)
+			}
+		}
+	}
+
+	// The metrics of the process are served along with those of the server.
+	for _, name := range []string{"toot_relay_push_total", "toot_relay_push_duration_seconds", "toot_relay_apns_reason_total", "toot_relay_apns_connections_total"} {
+		if types[name] == "" {
+			t.Errorf("metric %s not served", name)
+		}
+	}
+}
+
+func TestMetricsToken(t *testing.T) {
+	tests := []struct {
+		authorization string
+		status        int
+	}{
+		{"", 401},
+		{"Bearer wrong", 401},
+		{"Bearer secret", 200},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "/metrics", nil)
+		if test.authorization != "" {
+			request.Header.Set("Authorization", test.authorization)
+		}
+
+		response := httptest.NewRecorder()
+		newTestRelay(&fakePusher{}).metricsHandler("secret")(response, request)
+		if response.Code != test.status {
+			t.Errorf("Authorization %q: got status %d, want %d", test.authorization, response.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// withAllowedOrigins only lets requests through to next if header names one of
+// allowedHosts. The header may hold either a host name or an origin such as
+// https://mastodon.example, of which only the host is compared. Requests
+// without the header are refused, as Mastodon servers do not send Origin, so
+// they can only be told apart by a header set by a proxy in front of the
+// relay. Without any allowed hosts, all requests are let through.
+func withAllowedOrigins(allowedHosts []string, header string, next http.HandlerFunc) http.HandlerFunc {
+	allowed := make(map[string]bool)
+	for _, host := range allowedHosts {
+		if host = originHost(host); host != "" {
+			allowed[host] = true
+		}
+	}
+	if len(allowed) == 0 {
+		return next
+	}
+
+	return func(writer http.ResponseWriter, request *http.Request) {
+		origin := request.Header.Get(header)
+		if origin == "" {
+			writer.WriteHeader(403)
+			fmt.Fprintln(writer, "Missing", header, "header")
+			logger.WarnContext(request.Context(), "Missing origin header", "header", header)
+			return
+		}
+		if !allowed[originHost(origin)] {
+			writer.WriteHeader(403)
+			fmt.Fprintln(writer, "Origin not allowed:", origin)
+			logger.WarnContext(request.Context(), "Origin not allowed", "origin", origin)
+			return
+		}
+
+		next(writer, request)
+	}
+}
+
+func originHost(origin string) string {
+	origin = strings.TrimSpace(origin)
+	if parsed, err := url.Parse(origin); err == nil && parsed.Host != "" {
+		origin = parsed.Host
+	}
+
+	return strings.ToLower(origin)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithAllowedOrigins(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		origin  string
+		status  int
+	}{
+		{[]string{"mastodon.social", "Mastodon.Example"}, "https://mastodon.social", 200},
+		{[]string{"mastodon.social", "Mastodon.Example"}, "mastodon.example", 200},
+		{[]string{"mastodon.social"}, "https://evil.example", 403},
+		{[]string{"mastodon.social"}, "", 403},
+		{[]string{""}, "", 200},
+		{[]string{""}, "https://evil.example", 200},
+	}
+
+	for _, test := range tests {
+		handler := withAllowedOrigins(test.allowed, "X-Forwarded-Host", func(writer http.ResponseWriter, request *http.Request) {})
+
+		request := httptest.NewRequest("POST", "/relay-to/production/"+testDeviceToken, nil)
+		if test.origin != "" {
+			request.Header.Set("X-Forwarded-Host", test.origin)
+		}
+		response := httptest.NewRecorder()
+		handler(response, request)
+
+		if response.Code != test.status {
+			t.Errorf("allowed %q with origin %q: got status %d, want %d", test.allowed, test.origin, response.Code, test.status)
+		}
+	}
+}
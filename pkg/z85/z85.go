@@ -0,0 +1,292 @@
+// Package z85 implements the Z85 encoding used by toot-relay to pass binary
+// data in APNs payloads, as specified in https://rfc.zeromq.org/spec:32/Z85/.
+//
+// Z85 itself only encodes data that is a multiple of four bytes long. Here, a
+// final block of n < 4 bytes is encoded as n+1 digits instead, the same way a
+// full block is, so that any data can be encoded. Clients need to decode it
+// the same way.
+package z85
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const digits = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ.-:+=^!/*?&<>()[]{}@%$#"
+
+var values = func() [256]int {
+	var values [256]int
+	for i := range values {
+		values[i] = -1
+	}
+	for i := 0; i < len(digits); i++ {
+		values[digits[i]] = i
+	}
+	return values
+}()
+
+// EncodedLen returns the length of the encoding of n bytes.
+func EncodedLen(n int) int {
+	encodedLength := n / 4 * 5
+	if suffixLength := n % 4; suffixLength != 0 {
+		encodedLength += suffixLength + 1
+	}
+	return encodedLength
+}
+
+// DecodedLen returns the length of the data encoded in n digits. It returns -1
+// if no data encodes to that length.
+func DecodedLen(n int) int {
+	suffixLength := n % 5
+	if suffixLength == 1 {
+		return -1
+	}
+
+	decodedLength := n / 5 * 4
+	if suffixLength != 0 {
+		decodedLength += suffixLength - 1
+	}
+	return decodedLength
+}
+
+// Encode returns the encoding of src.
+func Encode(src []byte) string {
+	return string(AppendEncode(nil, src))
+}
+
+// AppendEncode appends the encoding of src to dest and returns the extended
+// slice, so that callers can reuse dest between calls.
+func AppendEncode(dest, src []byte) []byte {
+	start := len(dest)
+	encodedLength := EncodedLen(len(src))
+	if cap(dest)-start < encodedLength {
+		grown := make([]byte, start, start+encodedLength)
+		copy(grown, dest)
+		dest = grown
+	}
+
+	dest = dest[:start+encodedLength]
+	encode(dest[start:], src)
+	return dest
+}
+
+// encode writes the encoding of src to dest, which must be EncodedLen(len(src))
+// bytes long.
+func encode(dest, src []byte) {
+	for len(src) >= 4 {
+		value := binary.BigEndian.Uint32(src)
+
+		for i := 0; i < 5; i++ {
+			dest[4-i] = digits[value%85]
+			value /= 85
+		}
+
+		src = src[4:]
+		dest = dest[5:]
+	}
+
+	if suffixLength := len(src); suffixLength != 0 {
+		value := 0
+
+		for i := 0; i < suffixLength; i++ {
+			value *= 256
+			value |= int(src[i])
+		}
+
+		for i := 0; i < suffixLength+1; i++ {
+			dest[suffixLength-i] = digits[value%85]
+			value /= 85
+		}
+	}
+}
+
+// Decode returns the data encoded in src, including a final block shorter than
+// four bytes.
+func Decode(src string) ([]byte, error) {
+	decodedLength := DecodedLen(len(src))
+	if decodedLength < 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid z85 length %d", len(src)))
+	}
+
+	dest := make([]byte, decodedLength)
+	if err := decode(dest, []byte(src)); err != nil {
+		return nil, err
+	}
+
+	return dest, nil
+}
+
+// decode writes the data encoded in src to dest, which must be
+// DecodedLen(len(src)) bytes long.
+func decode(dest, src []byte) error {
+	for len(src) >= 5 {
+		value, err := decodeDigits(src[:5])
+		if err != nil {
+			return err
+		}
+		if value > 0xffffffff {
+			return errors.New(fmt.Sprintf("Invalid z85 block %q", src[:5]))
+		}
+
+		binary.BigEndian.PutUint32(dest, uint32(value))
+
+		src = src[5:]
+		dest = dest[4:]
+	}
+
+	if suffixLength := len(src); suffixLength != 0 {
+		value, err := decodeDigits(src)
+		if err != nil {
+			return err
+		}
+		if value >= 1<<(8*uint(suffixLength-1)) {
+			return errors.New(fmt.Sprintf("Invalid z85 suffix %q", src))
+		}
+
+		for i := 0; i < suffixLength-1; i++ {
+			dest[suffixLength-2-i] = byte(value)
+			value >>= 8
+		}
+	}
+
+	return nil
+}
+
+func decodeDigits(src []byte) (uint64, error) {
+	var value uint64
+
+	for _, digit := range src {
+		digitValue := values[digit]
+		if digitValue < 0 {
+			return 0, errors.New(fmt.Sprintf("Invalid z85 character %q", digit))
+		}
+
+		value = value*85 + uint64(digitValue)
+	}
+
+	return value, nil
+}
+
+type encoder struct {
+	w        io.Writer
+	pending  [4]byte
+	npending int
+	out      [5 * 64]byte
+	err      error
+}
+
+// NewEncoder returns a stream encoder that writes the encoding of everything
+// written to it to w. As with encoding/base64, the final partial block is only
+// written when the encoder is closed.
+func NewEncoder(w io.Writer) io.WriteCloser {
+	return &encoder{w: w}
+}
+
+func (e *encoder) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	written := len(p)
+
+	// Complete a block left over from the previous write first.
+	if e.npending > 0 {
+		n := copy(e.pending[e.npending:], p)
+		e.npending += n
+		p = p[n:]
+		if e.npending < 4 {
+			return written, nil
+		}
+
+		encode(e.out[:5], e.pending[:])
+		e.npending = 0
+		if _, e.err = e.w.Write(e.out[:5]); e.err != nil {
+			return 0, e.err
+		}
+	}
+
+	// Then encode as many whole blocks as fit in the output buffer at a time.
+	for len(p) >= 4 {
+		blocks := len(p) / 4
+		if blocks > len(e.out)/5 {
+			blocks = len(e.out) / 5
+		}
+
+		encode(e.out[:blocks*5], p[:blocks*4])
+		if _, e.err = e.w.Write(e.out[:blocks*5]); e.err != nil {
+			return 0, e.err
+		}
+		p = p[blocks*4:]
+	}
+
+	e.npending = copy(e.pending[:], p)
+	return written, nil
+}
+
+// Close writes any pending partial block. It does not close the underlying writer.
+func (e *encoder) Close() error {
+	if e.err != nil || e.npending == 0 {
+		return e.err
+	}
+
+	encodedLength := EncodedLen(e.npending)
+	encode(e.out[:encodedLength], e.pending[:e.npending])
+	e.npending = 0
+	_, e.err = e.w.Write(e.out[:encodedLength])
+	return e.err
+}
+
+type decoder struct {
+	r       io.Reader
+	pending []byte
+	decoded []byte
+	err     error
+}
+
+// NewDecoder returns a stream decoder that reads encoded data from r.
+func NewDecoder(r io.Reader) io.Reader {
+	return &decoder{r: r}
+}
+
+func (d *decoder) Read(p []byte) (int, error) {
+	for len(d.decoded) == 0 && d.err == nil {
+		buffer := make([]byte, 1024)
+		n, err := d.r.Read(buffer)
+		d.pending = append(d.pending, buffer[:n]...)
+
+		// A final partial block can only be told apart from a full one at
+		// the end of the input.
+		blocks := len(d.pending) / 5 * 5
+		if err != nil {
+			blocks = len(d.pending)
+		}
+
+		if blocks > 0 {
+			decodedLength := DecodedLen(blocks)
+			if decodedLength < 0 {
+				d.err = errors.New(fmt.Sprintf("Invalid z85 length %d", blocks))
+				break
+			}
+
+			d.decoded = make([]byte, decodedLength)
+			if d.err = decode(d.decoded, d.pending[:blocks]); d.err != nil {
+				d.decoded = nil
+				break
+			}
+			d.pending = d.pending[blocks:]
+		}
+
+		if err != nil {
+			d.err = err
+		}
+	}
+
+	n := copy(p, d.decoded)
+	d.decoded = d.decoded[n:]
+	if n > 0 {
+		return n, nil
+	}
+
+	return 0, d.err
+}
@@ -0,0 +1,251 @@
+package z85
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// randomBytes returns n bytes that are the same on every run.
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+func TestEncodeSpec(t *testing.T) {
+	// The example from the Z85 specification.
+	data := []byte{0x86, 0x4F, 0xD2, 0x6F, 0xB5, 0x59, 0xF7, 0x5B}
+	if encoded := Encode(data); encoded != "HelloWorld" {
+		t.Errorf("got %q, want HelloWorld", encoded)
+	}
+
+	decoded, err := Decode("HelloWorld")
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Errorf("got %x, %v, want %x", decoded, err, data)
+	}
+}
+
+func TestLengths(t *testing.T) {
+	encodedLengths := []int{0, 2, 3, 4, 5, 7, 8, 9, 10, 12}
+	for n, want := range encodedLengths {
+		if length := EncodedLen(n); length != want {
+			t.Errorf("EncodedLen(%d): got %d, want %d", n, length, want)
+		}
+		if length := DecodedLen(want); length != n {
+			t.Errorf("DecodedLen(%d): got %d, want %d", want, length, n)
+		}
+	}
+
+	for _, n := range []int{1, 6, 11} {
+		if length := DecodedLen(n); length != -1 {
+			t.Errorf("DecodedLen(%d): got %d, want -1", n, length)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for n := 0; n <= 20; n++ {
+		data := randomBytes(n)
+		encoded := Encode(data)
+		if len(encoded) != EncodedLen(n) {
+			t.Errorf("%d bytes: got %d digits, want %d", n, len(encoded), EncodedLen(n))
+		}
+
+		decoded, err := Decode(encoded)
+		if err != nil {
+			t.Errorf("%d bytes: %v", n, err)
+		} else if !bytes.Equal(decoded, data) {
+			t.Errorf("%d bytes: got %x, want %x", n, decoded, data)
+		}
+	}
+
+	// The largest values of each block length.
+	for n := 1; n <= 8; n++ {
+		data := bytes.Repeat([]byte{0xff}, n)
+		if decoded, err := Decode(Encode(data)); err != nil || !bytes.Equal(decoded, data) {
+			t.Errorf("%x: got %x, %v", data, decoded, err)
+		}
+	}
+}
+
+func TestAppendEncode(t *testing.T) {
+	dest := []byte("prefix:")
+	dest = AppendEncode(dest, []byte{0x86, 0x4F, 0xD2, 0x6F, 0xB5})
+	if string(dest) != "prefix:"+Encode([]byte{0x86, 0x4F, 0xD2, 0x6F, 0xB5}) {
+		t.Errorf("got %q", dest)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"length of one digit", "0"},
+		{"length of six digits", "000000"},
+		{"space", "Hello World"},
+		{"tilde", "Hello~orld"},
+		{"non-ASCII", "Helloé"},
+		{"block larger than 32 bits", "%%%%%"},
+		{"suffix larger than its bytes", "%%"},
+	}
+
+	for _, test := range tests {
+		if decoded, err := Decode(test.encoded); err == nil {
+			t.Errorf("%s: got %x, want an error", test.name, decoded)
+		}
+	}
+}
+
+// writeChunked writes data to w in chunks of the sizes in sizes, repeating the
+// last one.
+func writeChunked(w io.Writer, data []byte, sizes []int) error {
+	for i := 0; len(data) > 0; i++ {
+		size := sizes[min(i, len(sizes)-1)]
+		size = min(size, len(data))
+		if _, err := w.Write(data[:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+func TestEncoder(t *testing.T) {
+	chunkSizes := [][]int{{1}, {3}, {5}, {7}, {1, 2, 3, 5, 8, 13}, {1000}}
+	for _, n := range []int{0, 1, 3, 4, 5, 9, 255, 256, 257, 1031, 4096} {
+		data := randomBytes(n)
+		for _, sizes := range chunkSizes {
+			var encoded strings.Builder
+			encoder := NewEncoder(&encoded)
+			if err := writeChunked(encoder, data, sizes); err != nil {
+				t.Fatal(err)
+			}
+			if err := encoder.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if encoded.String() != Encode(data) {
+				t.Errorf("%d bytes in chunks of %v: got %q, want %q", n, sizes, encoded.String(), Encode(data))
+			}
+		}
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	for _, n := range []int{0, 1, 3, 4, 5, 9, 255, 256, 257, 1031, 4096} {
+		data := randomBytes(n)
+		readers := map[string]func(io.Reader) io.Reader{
+			"whole":    func(r io.Reader) io.Reader { return r },
+			"one byte": iotest.OneByteReader,
+			"half":     iotest.HalfReader,
+		}
+
+		for name, reader := range readers {
+			decoded, err := io.ReadAll(iotest.OneByteReader(NewDecoder(reader(strings.NewReader(Encode(data))))))
+			if err != nil {
+				t.Errorf("%d bytes, %s: %v", n, name, err)
+			} else if !bytes.Equal(decoded, data) {
+				t.Errorf("%d bytes, %s: got %x, want %x", n, name, decoded, data)
+			}
+		}
+	}
+}
+
+func TestDecoderInvalid(t *testing.T) {
+	for _, encoded := range []string{"Hello World", "HelloWorld0", "%%%%%"} {
+		if _, err := io.ReadAll(NewDecoder(iotest.OneByteReader(strings.NewReader(encoded)))); err == nil {
+			t.Errorf("%q: got no error", encoded)
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrShortWrite
+}
+
+func TestEncoderWriteError(t *testing.T) {
+	encoder := NewEncoder(failingWriter{})
+	if _, err := encoder.Write(randomBytes(8)); err != io.ErrShortWrite {
+		t.Errorf("got error %v, want io.ErrShortWrite", err)
+	}
+	if err := encoder.Close(); err != io.ErrShortWrite {
+		t.Errorf("got error %v from Close, want io.ErrShortWrite", err)
+	}
+}
+
+func FuzzZ85(f *testing.F) {
+	f.Add([]byte("HelloWorld"), uint8(3))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff}, uint8(0))
+	f.Add(randomBytes(257), uint8(128))
+
+	f.Fuzz(func(t *testing.T, data []byte, chunkSize uint8) {
+		encoded := Encode(data)
+		decoded, err := Decode(encoded)
+		if err != nil || !bytes.Equal(decoded, data) {
+			t.Fatalf("%x: decoded %q to %x, %v", data, encoded, decoded, err)
+		}
+
+		var streamed strings.Builder
+		encoder := NewEncoder(&streamed)
+		if err := writeChunked(encoder, data, []int{int(chunkSize) + 1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := encoder.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if streamed.String() != encoded {
+			t.Fatalf("%x: encoder wrote %q, want %q", data, streamed.String(), encoded)
+		}
+
+		streamedData, err := io.ReadAll(iotest.OneByteReader(NewDecoder(strings.NewReader(encoded))))
+		if err != nil || !bytes.Equal(streamedData, data) {
+			t.Fatalf("%x: decoder read %x, %v", data, streamedData, err)
+		}
+
+		// Arbitrary input may be rejected, but must not crash the decoders.
+		Decode(string(data))
+		io.ReadAll(NewDecoder(bytes.NewReader(data)))
+	})
+}
+
+func BenchmarkEncode(b *testing.B) {
+	data := randomBytes(4096)
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Encode(data)
+	}
+}
+
+func BenchmarkAppendEncode(b *testing.B) {
+	data := randomBytes(4096)
+	dest := make([]byte, 0, EncodedLen(len(data)))
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dest = AppendEncode(dest[:0], data)
+	}
+}
+
+func BenchmarkEncoder(b *testing.B) {
+	data := randomBytes(4096)
+	var encoded strings.Builder
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		encoded.Reset()
+		encoder := NewEncoder(&encoded)
+		encoder.Write(data)
+		encoder.Close()
+	}
+}
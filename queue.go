@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sideshow/apns2"
+)
+
+var (
+	errQueueFull   = errors.New("Push queue is full")
+	errQueueClosed = errors.New("Shutting down, not queueing notifications")
+)
+
+// pushQueue holds notifications that are sent in the background by a pool of
+// workers, if PUSH_QUEUE is enabled.
+type pushQueue struct {
+	jobs chan pushJob
+
+	// mutex guards closing jobs, which handlers that outlive the shutdown
+	// timeout may still be adding to, and closed is set once it has been
+	// closed.
+	mutex  sync.RWMutex
+	closed bool
+
+	workers sync.WaitGroup
+}
+
+type pushJob struct {
+	ctx          context.Context
+	start        time.Time
+	client       pusher
+	notification *apns2.Notification
+	log          *slog.Logger
+}
+
+// startPushWorkers sends notifications through a queue of depth, with workers
+// sending them in the background.
+func (s *relayServer) startPushWorkers(depth, workers int) {
+	s.queue = &pushQueue{jobs: make(chan pushJob, depth)}
+	s.metrics.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "toot_relay_queue_depth",
+		Help: "Notifications waiting to be sent.",
+	}, func() float64 {
+		return float64(len(s.queue.jobs))
+	}))
+
+	for i := 0; i < workers; i++ {
+		s.queue.workers.Add(1)
+		go func() {
+			defer s.queue.workers.Done()
+			for job := range s.queue.jobs {
+				s.send(job.ctx, job.start, job.client, job.notification, job.log)
+			}
+		}()
+	}
+}
+
+// enqueue adds a notification to the queue. It returns errQueueFull if the
+// queue is full, or errQueueClosed once it is being drained.
+func (q *pushQueue) enqueue(job pushJob) error {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	if q.closed {
+		return errQueueClosed
+	}
+
+	select {
+	case q.jobs <- job:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// full reports whether no more notifications can be queued right now.
+func (q *pushQueue) full() bool {
+	return len(q.jobs) == cap(q.jobs)
+}
+
+// drain stops accepting notifications, and waits until those already queued
+// have been sent or ctx is done.
+func (q *pushQueue) drain(ctx context.Context) error {
+	q.mutex.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
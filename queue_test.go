@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHandlerQueue(t *testing.T) {
+	pusher := &fakePusher{}
+	relay := newTestRelay(pusher)
+	relay.startPushWorkers(10, 2)
+
+	response := post(relay, relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders()))
+	if response.Code != 202 {
+		t.Fatalf("got status %d, want 202", response.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := relay.queue.drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(pusher.pushed()) != 1 {
+		t.Errorf("got %d notifications after draining, want 1", len(pusher.pushed()))
+	}
+}
+
+func TestHandlerQueueFull(t *testing.T) {
+	// Without workers, nothing is taken off the queue.
+	relay := newTestRelay(&fakePusher{})
+	relay.startPushWorkers(1, 0)
+
+	if response := post(relay, relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders())); response.Code != 202 {
+		t.Fatalf("got status %d, want 202", response.Code)
+	}
+
+	response := post(relay, relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders()))
+	if response.Code != 503 {
+		t.Errorf("got status %d, want 503", response.Code)
+	}
+	if retryAfter := response.Header().Get("Retry-After"); retryAfter != "5" {
+		t.Errorf("got Retry-After %q, want 5", retryAfter)
+	}
+}
+
+func TestHandlerQueueDrained(t *testing.T) {
+	pusher := &fakePusher{}
+	relay := newTestRelay(pusher)
+	relay.startPushWorkers(10, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := relay.queue.drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A handler still running once the queue has been closed must not send
+	// on it.
+	response := post(relay, relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders()))
+	if response.Code != 503 {
+		t.Errorf("got status %d, want 503", response.Code)
+	}
+	if err := relay.queue.enqueue(pushJob{}); err != errQueueClosed {
+		t.Errorf("got error %v, want errQueueClosed", err)
+	}
+}
+
+func TestHandlerPushSlots(t *testing.T) {
+	pusher := &fakePusher{}
+	relay := newTestRelay(pusher)
+	relay.pushSlots = make(chan struct{}, 1)
+
+	relay.pushSlots <- struct{}{}
+	response := post(relay, relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders()))
+	if response.Code != 503 || response.Header().Get("Retry-After") != "1" {
+		t.Fatalf("got status %d with Retry-After %q, want 503 with 1", response.Code, response.Header().Get("Retry-After"))
+	}
+	if len(pusher.pushed()) != 0 {
+		t.Fatal("notification was pushed without a free slot")
+	}
+
+	<-relay.pushSlots
+	if response := post(relay, relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders())); response.Code != 201 {
+		t.Fatalf("got status %d once a slot was freed, want 201", response.Code)
+	}
+	if len(relay.pushSlots) != 0 {
+		t.Error("slot was not given back after pushing")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter limits how many notifications each device token is sent, to
+// perToken a second with bursts of up to burst. It holds a limiter for every
+// device token seen recently, in least recently used order, so that the oldest
+// can be evicted when there are more than maxTokens.
+type rateLimiter struct {
+	perToken  rate.Limit
+	burst     int
+	maxTokens int
+
+	mutex   sync.Mutex
+	order   *list.List
+	byToken map[string]*list.Element
+}
+
+type tokenLimiter struct {
+	deviceToken string
+	limiter     *rate.Limiter
+	lastSeen    time.Time
+}
+
+func newRateLimiter(perToken rate.Limit, burst, maxTokens int) *rateLimiter {
+	return &rateLimiter{
+		perToken:  perToken,
+		burst:     burst,
+		maxTokens: maxTokens,
+		order:     list.New(),
+		byToken:   make(map[string]*list.Element),
+	}
+}
+
+// allow reports whether another notification may be sent to a device token
+// right now. If not, it also returns how long until one may be sent.
+func (l *rateLimiter) allow(deviceToken string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var entry *tokenLimiter
+	if element, exists := l.byToken[deviceToken]; exists {
+		l.order.MoveToFront(element)
+		entry = element.Value.(*tokenLimiter)
+	} else {
+		entry = &tokenLimiter{deviceToken: deviceToken, limiter: rate.NewLimiter(l.perToken, l.burst)}
+		l.byToken[deviceToken] = l.order.PushFront(entry)
+
+		for l.order.Len() > l.maxTokens {
+			l.evictOldest()
+		}
+	}
+	entry.lastSeen = time.Now()
+
+	reservation := entry.limiter.Reserve()
+	if delay := reservation.Delay(); delay > 0 {
+		reservation.Cancel()
+		return false, delay
+	}
+
+	return true, 0
+}
+
+// collect periodically forgets device tokens that have not been seen for
+// maxAge, so that memory is released even when under maxTokens.
+func (l *rateLimiter) collect(maxAge time.Duration) {
+	for range time.Tick(maxAge / 6) {
+		cutoff := time.Now().Add(-maxAge)
+
+		l.mutex.Lock()
+		for l.order.Len() > 0 && l.order.Back().Value.(*tokenLimiter).lastSeen.Before(cutoff) {
+			l.evictOldest()
+		}
+		l.mutex.Unlock()
+	}
+}
+
+func (l *rateLimiter) evictOldest() {
+	oldest := l.order.Back()
+	l.order.Remove(oldest)
+	delete(l.byToken, oldest.Value.(*tokenLimiter).deviceToken)
+}
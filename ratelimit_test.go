@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHandlerRateLimit(t *testing.T) {
+	pusher := &fakePusher{}
+	relay := newTestRelay(pusher)
+	relay.limiter = newRateLimiter(0.001, 3, 100)
+	for i := 0; i < 3; i++ {
+		if response := post(relay, relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders())); response.Code != 201 {
+			t.Fatalf("request %d: got status %d, want 201", i+1, response.Code)
+		}
+	}
+
+	response := post(relay, relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders()))
+	if response.Code != 429 {
+		t.Errorf("got status %d, want 429", response.Code)
+	}
+	if response.Header().Get("Retry-After") == "" {
+		t.Error("got no Retry-After")
+	}
+	if len(pusher.pushed()) != 3 {
+		t.Errorf("got %d notifications, want 3", len(pusher.pushed()))
+	}
+
+	// Other device tokens have limits of their own.
+	otherToken := testDeviceToken[:60] + "0000"
+	if response := post(relay, relayRequest(otherToken, []byte("message"), aesgcmHeaders())); response.Code != 201 {
+		t.Errorf("other device token: got status %d, want 201", response.Code)
+	}
+}
+
+func TestRateLimitEviction(t *testing.T) {
+	limiter := newRateLimiter(0.001, 1, 2)
+
+	limiter.allow("a")
+	limiter.allow("b")
+	// Seeing a again makes b the least recently used.
+	limiter.allow("a")
+	limiter.allow("c")
+
+	if _, exists := limiter.byToken["b"]; exists {
+		t.Error("least recently used device token not evicted")
+	}
+	if limiter.order.Len() != 2 || len(limiter.byToken) != 2 {
+		t.Errorf("got %d limiters, want 2", limiter.order.Len())
+	}
+
+	// Only the limit of b was forgotten.
+	if allowed, _ := limiter.allow("a"); allowed {
+		t.Error("limit of a forgotten")
+	}
+	if allowed, _ := limiter.allow("b"); !allowed {
+		t.Error("limit of evicted b kept")
+	}
+}
+
+func TestHandlerRateLimitDisabled(t *testing.T) {
+	// With RATE_LIMIT_PER_TOKEN of 0, the relay has no limiter.
+	relay := newTestRelay(&fakePusher{})
+	for i := 0; i < 10; i++ {
+		if response := post(relay, relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders())); response.Code != 201 {
+			t.Fatalf("request %d: got status %d, want 201", i+1, response.Code)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+type registration struct {
+	Topic       string `json:"topic,omitempty"`
+	Environment string `json:"environment"`
+	RelayURL    string `json:"relay_url"`
+}
+
+// registrationHandler describes where notifications posted to a relay URL
+// would be sent, so that client developers can check their subscriptions
+// without sending a notification. Whether the device token is actually
+// registered with APNs can only be found out by pushing to it, so any valid
+// token is accepted.
+func registrationHandler(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	appTopic, isApp := appTopics[request.PathValue("app")]
+
+	if _, err := normalizeDeviceToken(request.PathValue("token")); err != nil {
+		writer.WriteHeader(400)
+		fmt.Fprintln(writer, "Invalid device token:", err)
+		logger.WarnContext(ctx, "Invalid device token", "error", err)
+		return
+	}
+
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	}
+
+	result := registration{
+		Environment: environmentName(request.PathValue("environment") == "production"),
+		RelayURL:    scheme + "://" + request.Host + request.URL.Path,
+	}
+	if fcmPusher == nil {
+		result.Topic = topic
+		if isApp {
+			result.Topic = appTopic
+		}
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(result)
+}
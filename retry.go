@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+var (
+	maxPushRetries = 3
+	retryBaseDelay = 100 * time.Millisecond
+
+	// maxRetryDelay is the longest to wait before a retry, however long APNs
+	// asks to wait in a Retry-After header, as the sender is kept waiting too.
+	maxRetryDelay = 30 * time.Second
+
+	// pushTimeout bounds each attempt, so that a hung connection is retried
+	// rather than blocking the request.
+	pushTimeout = 10 * time.Second
+)
+
+// pusher is implemented by apns2.Client, and by fcmClient for the FCM backend.
+type pusher interface {
+	Push(notification *apns2.Notification) (*apns2.Response, error)
+	PushWithContext(ctx apns2.Context, notification *apns2.Notification) (*apns2.Response, error)
+}
+
+// errNotificationExpired is returned by pushWithRetry when the notification
+// expires before it could be delivered, making further retries pointless.
+var errNotificationExpired = errors.New("Notification expired while retrying")
+
+// pushWithRetry pushes a notification, retrying transient failures with
+// exponential backoff and jitter, or after the delay given by APNs in a
+// Retry-After header if that is longer, up to maxRetryDelay. It gives up early
+// if ctx would be done before the next attempt.
+func (s *relayServer) pushWithRetry(ctx context.Context, client pusher, notification *apns2.Notification, log *slog.Logger) (*apns2.Response, error) {
+	for attempt := 1; ; attempt++ {
+		var retryAfter time.Duration
+		pushStart := time.Now()
+		attemptCtx, cancel := context.WithTimeout(context.WithValue(ctx, retryAfterKey, &retryAfter), pushTimeout)
+		res, err := client.PushWithContext(attemptCtx, notification)
+		cancel()
+		s.metrics.pushDuration.observe(time.Since(pushStart).Seconds())
+		if !isTransient(res, err) || attempt > maxPushRetries {
+			return res, err
+		}
+
+		delay := retryBaseDelay << uint(attempt-1)
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+
+		if !notification.Expiration.IsZero() && time.Now().Add(delay).After(notification.Expiration) {
+			return res, errNotificationExpired
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return res, err
+		}
+
+		if err != nil {
+			log.WarnContext(ctx, "Retrying push", "attempt", attempt, "error", err)
+		} else {
+			log.WarnContext(ctx, "Retrying push", "attempt", attempt, "status", res.StatusCode, "error", res.Reason)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// isTransient reports whether a push failed in a way that may succeed if retried.
+// Rejections of the notification itself, such as BadDeviceToken, are final, as are
+// errors that happen before anything is sent, such as failing to encode the payload.
+func isTransient(res *apns2.Response, err error) bool {
+	if err != nil {
+		var netErr net.Error
+		return errors.As(err, &netErr)
+	}
+
+	return res.StatusCode == 429 || res.StatusCode >= 500
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+// pusherFunc is a pusher that calls itself.
+type pusherFunc func(ctx apns2.Context, notification *apns2.Notification) (*apns2.Response, error)
+
+func (f pusherFunc) Push(notification *apns2.Notification) (*apns2.Response, error) {
+	return f(nil, notification)
+}
+
+func (f pusherFunc) PushWithContext(ctx apns2.Context, notification *apns2.Notification) (*apns2.Response, error) {
+	return f(ctx, notification)
+}
+
+// failingPusher answers the first failures attempts with res, and later ones
+// as sent. It counts the attempts in attempts.
+func failingPusher(failures int, res *apns2.Response, attempts *int) pusherFunc {
+	return func(ctx apns2.Context, notification *apns2.Notification) (*apns2.Response, error) {
+		*attempts++
+		if *attempts <= failures {
+			return res, nil
+		}
+		return &apns2.Response{StatusCode: 200}, nil
+	}
+}
+
+func TestPushWithRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		res      *apns2.Response
+		status   int
+		attempts int
+	}{
+		{"transient twice", 2, &apns2.Response{StatusCode: 503}, 200, 3},
+		{"too many requests", 1, &apns2.Response{StatusCode: 429, Reason: apns2.ReasonTooManyRequests}, 200, 2},
+		{"transient throughout", 10, &apns2.Response{StatusCode: 500}, 500, 4},
+		{"rejected", 10, &apns2.Response{StatusCode: 400, Reason: apns2.ReasonBadDeviceToken}, 400, 1},
+	}
+
+	for _, test := range tests {
+		attempts := 0
+		res, err := newTestRelay(nil).pushWithRetry(context.Background(), failingPusher(test.failures, test.res, &attempts), &apns2.Notification{}, logger)
+		if err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if res.StatusCode != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, res.StatusCode, test.status)
+		}
+		if attempts != test.attempts {
+			t.Errorf("%s: got %d attempts, want %d", test.name, attempts, test.attempts)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name      string
+		res       *apns2.Response
+		err       error
+		transient bool
+	}{
+		{"network error", nil, &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"timeout", nil, context.DeadlineExceeded, true},
+		{"encoding error", nil, errors.New("json: unsupported value"), false},
+		{"sent", &apns2.Response{StatusCode: 200}, nil, false},
+		{"bad device token", &apns2.Response{StatusCode: 400, Reason: apns2.ReasonBadDeviceToken}, nil, false},
+		{"unregistered", &apns2.Response{StatusCode: 410, Reason: apns2.ReasonUnregistered}, nil, false},
+		{"too many requests", &apns2.Response{StatusCode: 429}, nil, true},
+		{"internal server error", &apns2.Response{StatusCode: 500}, nil, true},
+		{"service unavailable", &apns2.Response{StatusCode: 503}, nil, true},
+	}
+
+	for _, test := range tests {
+		if transient := isTransient(test.res, test.err); transient != test.transient {
+			t.Errorf("%s: got %v, want %v", test.name, transient, test.transient)
+		}
+	}
+}
+
+// retryAfterPusher answers with 429 and a Retry-After of delay, as apnsTransport
+// would pass it on, then as sent.
+func retryAfterPusher(delay time.Duration, attempts *int) pusherFunc {
+	return func(ctx apns2.Context, notification *apns2.Notification) (*apns2.Response, error) {
+		*attempts++
+		if *attempts > 1 {
+			return &apns2.Response{StatusCode: 200}, nil
+		}
+
+		*ctx.Value(retryAfterKey).(*time.Duration) = delay
+		return &apns2.Response{StatusCode: 429}, nil
+	}
+}
+
+func TestPushWithRetryAfter(t *testing.T) {
+	defer func(delay time.Duration) { maxRetryDelay = delay }(maxRetryDelay)
+	maxRetryDelay = time.Second
+
+	attempts := 0
+	start := time.Now()
+	res, err := newTestRelay(nil).pushWithRetry(context.Background(), retryAfterPusher(50*time.Millisecond, &attempts), &apns2.Notification{}, logger)
+	if err != nil || !res.Sent() {
+		t.Fatalf("got %v, %v, want sent", res, err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("retried after %v, before Retry-After", waited)
+	}
+}
+
+func TestPushWithRetryAfterCapped(t *testing.T) {
+	defer func(delay time.Duration) { maxRetryDelay = delay }(maxRetryDelay)
+	maxRetryDelay = 10 * time.Millisecond
+
+	attempts := 0
+	start := time.Now()
+	res, err := newTestRelay(nil).pushWithRetry(context.Background(), retryAfterPusher(time.Hour, &attempts), &apns2.Notification{}, logger)
+	if err != nil || !res.Sent() {
+		t.Fatalf("got %v, %v, want sent", res, err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("waited %v for a Retry-After longer than maxRetryDelay", waited)
+	}
+}
+
+func TestPushWithRetryAfterDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	attempts := 0
+	start := time.Now()
+	res, err := newTestRelay(nil).pushWithRetry(ctx, retryAfterPusher(10*time.Second, &attempts), &apns2.Notification{}, logger)
+	if err != nil || res.StatusCode != 429 {
+		t.Fatalf("got %v, %v, want the 429", res, err)
+	}
+	if attempts != 1 {
+		t.Errorf("got %d attempts, want 1", attempts)
+	}
+	if waited := time.Since(start); waited > 50*time.Millisecond {
+		t.Errorf("waited %v rather than giving up", waited)
+	}
+}
+
+func TestPushWithRetryExpired(t *testing.T) {
+	attempts := 0
+	notification := &apns2.Notification{Expiration: time.Now().Add(10 * time.Millisecond)}
+	_, err := newTestRelay(nil).pushWithRetry(context.Background(), retryAfterPusher(time.Second, &attempts), notification, logger)
+	if err != errNotificationExpired {
+		t.Errorf("got error %v, want errNotificationExpired", err)
+	}
+}
+
+func TestHandlerPushTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { pushTimeout = timeout }(pushTimeout)
+	pushTimeout = 10 * time.Millisecond
+
+	// A connection that hangs until the attempt is given up on.
+	var attempts atomic.Int32
+	hung := pusherFunc(func(ctx apns2.Context, notification *apns2.Notification) (*apns2.Response, error) {
+		attempts.Add(1)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	response := post(newTestRelay(hung), relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders()))
+	if response.Code != 504 {
+		t.Errorf("got status %d, want 504", response.Code)
+	}
+	if attempts.Load() != int32(maxPushRetries+1) {
+		t.Errorf("got %d attempts, want %d", attempts.Load(), maxPushRetries+1)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/sideshow/apns2"
+)
+
+// relayServer relays notifications to the clients it was created with, rather
+// than ones in package variables, so that they can be swapped out, such as for
+// fakes that record notifications instead of sending them. The same goes for
+// the rest of the state of sending them, and their metrics.
+type relayServer struct {
+	// mutex guards clients, which are replaced when the signing key is
+	// reloaded.
+	mutex sync.RWMutex
+
+	// clients send notifications for topics without an app of their own. With
+	// the FCM backend, both of them are the FCM client.
+	clients clientPair
+
+	// apps holds the clients for the apps in APNS_CONFIG_FILE, keyed by topic.
+	apps map[string]clientPair
+
+	// dryRun builds notifications and returns them without sending them, which
+	// can also be requested per request with the X-Dry-Run header. It is set by
+	// DRY_RUN or the -dry-run flag.
+	dryRun bool
+
+	// queue is only set if PUSH_QUEUE is enabled, in which case notifications
+	// are sent in the background.
+	queue *pushQueue
+
+	// pushSlots limits how many notifications are sent at once when they are
+	// not queued, if MAX_CONCURRENT_PUSHES is set. Each push holds a slot
+	// while it is being sent.
+	pushSlots chan struct{}
+
+	// breaker stops sending notifications for a while once sending them
+	// keeps failing, once it is set up from CIRCUIT_BREAKER_FAILURES.
+	breaker *circuitBreaker
+
+	// limiter is only set if RATE_LIMIT_PER_TOKEN is not 0, and sent unless
+	// DEDUP_CACHE_SIZE is 0.
+	limiter *rateLimiter
+	sent    *dedupCache
+
+	metrics *relayMetrics
+}
+
+// newRelayServer returns a server that sends notifications with clients, and
+// none of queueing, rate limiting, deduplication or the circuit breaker until
+// they are set up.
+func newRelayServer(clients clientPair) *relayServer {
+	return &relayServer{
+		clients: clients,
+		breaker: newCircuitBreaker(0, 0),
+		metrics: newRelayMetrics(),
+	}
+}
+
+// clientsFor returns the clients to send notifications for topic with.
+func (s *relayServer) clientsFor(topic string) clientPair {
+	if clients, exists := s.apps[topic]; exists {
+		return clients
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.clients
+}
+
+// setClients replaces the clients for topics without an app of their own, and
+// returns the previous ones. Notifications already being sent with those are
+// not affected.
+func (s *relayServer) setClients(clients clientPair) clientPair {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	previous := s.clients
+	s.clients = clients
+	return previous
+}
+
+// productionClient returns the APNs client for the production environment, or
+// nil if there is none.
+func (s *relayServer) productionClient() *apns2.Client {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	client, _ := s.clients.production.(*apns2.Client)
+	return client
+}
+
+// route registers the relay URLs on mux. Their handlers are wrapped in
+// authorized, which is told whether the handler pushes notifications, and
+// allow browsers on corsAllowOrigin to call them.
+//
+// Relay URLs can also start with the name of an app in APNS_CONFIG_FILE, to
+// push to its topic. GET describes a registration, and OPTIONS is answered by
+// withCORS. Other methods get 405 from the mux.
+func (s *relayServer) route(mux *http.ServeMux, corsAllowOrigin string, authorized func(next http.HandlerFunc, forPush bool) http.HandlerFunc) {
+	relayHandler := authorized(withOctetStream(s.handler), true)
+	batchHandler := authorized(s.batchHandler, true)
+	describeHandler := authorized(registrationHandler, false)
+
+	prefixes := map[string]string{"/relay-to": ""}
+	for name := range appTopics {
+		prefixes["/relay-to/"+name] = name
+	}
+	for prefix, app := range prefixes {
+		route := func(pattern string, next http.HandlerFunc) http.HandlerFunc {
+			if app != "" {
+				next = withApp(app, next)
+			}
+			return withCORS(corsAllowOrigin, withRequestID(withTracing(pattern, withRecover(next))))
+		}
+
+		for _, pattern := range []string{prefix + "/{environment}/{token}", prefix + "/{environment}/{token}/{extra...}"} {
+			mux.HandleFunc("POST "+pattern, route(pattern, relayHandler))
+			mux.HandleFunc("GET "+pattern, route(pattern, describeHandler))
+			mux.HandleFunc("OPTIONS "+pattern, route(pattern, relayHandler))
+		}
+		pattern := prefix + "/{environment}/{$}"
+		mux.HandleFunc("POST "+pattern, route(pattern, batchHandler))
+		mux.HandleFunc("OPTIONS "+pattern, route(pattern, batchHandler))
+	}
+
+	mux.HandleFunc("/relay-batch", withCORS(corsAllowOrigin, withRequestID(withTracing("/relay-batch", withRecover(authorized(s.relayBatchHandler, true))))))
+}
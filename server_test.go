@@ -0,0 +1,211 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+// newTestMux returns a mux with the relay URLs of relay, without any access
+// checks.
+func newTestMux(relay *relayServer) *http.ServeMux {
+	mux := http.NewServeMux()
+	relay.route(mux, "*", func(next http.HandlerFunc, forPush bool) http.HandlerFunc { return next })
+	return mux
+}
+
+// serve sends request to mux, and returns the response.
+func serve(mux http.Handler, request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestMalformedRelayPaths(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"POST", "/relay-to", 404},
+		{"POST", "/relay-to/", 404},
+		{"GET", "/relay-to/", 404},
+		{"GET", "/relay-to/production/", 405},
+		{"POST", "/relay-to/production/not-a-token", 400},
+		// Paths are cleaned by redirecting to the clean path, which is then
+		// one of the above.
+		{"POST", "/relay-to//extra", 307},
+		{"POST", "/relay-to/production//extra", 307},
+	}
+
+	for _, test := range tests {
+		pusher := &fakePusher{}
+		response := serve(newTestMux(newTestRelay(pusher)), httptest.NewRequest(test.method, test.path, strings.NewReader("message")))
+		if response.Code != test.status {
+			t.Errorf("%s %s: got status %d, want %d", test.method, test.path, response.Code, test.status)
+		}
+		if len(pusher.pushed()) != 0 {
+			t.Errorf("%s %s: pushed a notification", test.method, test.path)
+		}
+	}
+}
+
+func TestAppRouting(t *testing.T) {
+	appTopics["example"] = "com.example.app"
+	defer delete(appTopics, "example")
+
+	defaultPusher, appPusher := &fakePusher{}, &fakePusher{}
+	relay := newTestRelay(defaultPusher)
+	relay.apps = map[string]clientPair{"com.example.app": {development: appPusher, production: appPusher}}
+	mux := newTestMux(relay)
+
+	tests := []struct {
+		path   string
+		pusher *fakePusher
+		topic  string
+	}{
+		{"/relay-to/production/" + testDeviceToken, defaultPusher, "cx.c3.toot"},
+		{"/relay-to/example/production/" + testDeviceToken, appPusher, "com.example.app"},
+		{"/relay-to/example/development/" + testDeviceToken + "/extra", appPusher, "com.example.app"},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest("POST", test.path, strings.NewReader("message"))
+		for name, value := range aesgcmHeaders() {
+			request.Header.Set(name, value)
+		}
+
+		before := len(test.pusher.pushed())
+		if response := serve(mux, request); response.Code != 201 {
+			t.Fatalf("%s: got status %d, want 201: %s", test.path, response.Code, response.Body)
+		}
+
+		notifications := test.pusher.pushed()
+		if len(notifications) != before+1 {
+			t.Fatalf("%s: not pushed with the client for its app", test.path)
+		}
+		if topic := notifications[len(notifications)-1].Topic; topic != test.topic {
+			t.Errorf("%s: got topic %q, want %q", test.path, topic, test.topic)
+		}
+	}
+
+	// Registrations describe the topic of the app too.
+	response := serve(mux, httptest.NewRequest("GET", "/relay-to/example/production/"+testDeviceToken, nil))
+	if !strings.Contains(response.Body.String(), `"topic":"com.example.app"`) {
+		t.Errorf("got registration %s, want the app topic", response.Body)
+	}
+}
+
+func TestRelayMethods(t *testing.T) {
+	for _, method := range []string{"PUT", "DELETE", "PATCH"} {
+		for _, path := range []string{"/relay-to/production/" + testDeviceToken, "/relay-to/production/"} {
+			pusher := &fakePusher{}
+			request := httptest.NewRequest(method, path, strings.NewReader("message"))
+			for name, value := range aesgcmHeaders() {
+				request.Header.Set(name, value)
+			}
+
+			response := serve(newTestMux(newTestRelay(pusher)), request)
+			if response.Code != 405 || !strings.Contains(response.Header().Get("Allow"), "POST") {
+				t.Errorf("%s %s: got status %d with Allow %q, want 405 allowing POST", method, path, response.Code, response.Header().Get("Allow"))
+			}
+			if len(pusher.pushed()) != 0 {
+				t.Errorf("%s %s: pushed a notification", method, path)
+			}
+		}
+	}
+
+	// GET describes the registration, and OPTIONS is a CORS preflight, so
+	// neither pushes.
+	for method, status := range map[string]int{"GET": 200, "OPTIONS": 204} {
+		pusher := &fakePusher{}
+		response := serve(newTestMux(newTestRelay(pusher)), httptest.NewRequest(method, "/relay-to/production/"+testDeviceToken, nil))
+		if response.Code != status || len(pusher.pushed()) != 0 {
+			t.Errorf("%s: got status %d and %d notifications, want %d and none", method, response.Code, len(pusher.pushed()), status)
+		}
+	}
+}
+
+func TestRelay(t *testing.T) {
+	badDeviceToken := strings.Repeat("0", 64)
+	pusher := &fakePusher{respond: func(notification *apns2.Notification) (*apns2.Response, error) {
+		if notification.DeviceToken == badDeviceToken {
+			return &apns2.Response{StatusCode: 400, Reason: apns2.ReasonBadDeviceToken}, nil
+		}
+		return &apns2.Response{StatusCode: 200, ApnsID: "8f7e2c1a-4b3d-4e5f-9a8b-7c6d5e4f3a2b"}, nil
+	}}
+	server := httptest.NewServer(newTestMux(newTestRelay(pusher)))
+	defer server.Close()
+
+	without := func(name string) map[string]string {
+		header := aesgcmHeaders()
+		delete(header, name)
+		return header
+	}
+	with := func(name, value string) map[string]string {
+		header := aesgcmHeaders()
+		header[name] = value
+		return header
+	}
+
+	tests := []struct {
+		name        string
+		deviceToken string
+		header      map[string]string
+		status      int
+		expires     time.Duration
+	}{
+		{"success", testDeviceToken, aesgcmHeaders(), 201, -1},
+		{"bad device token", badDeviceToken, aesgcmHeaders(), 400, -1},
+		{"no Crypto-Key", testDeviceToken, without("Crypto-Key"), 400, -1},
+		{"no Encryption", testDeviceToken, without("Encryption"), 400, -1},
+		{"no Content-Encoding", testDeviceToken, without("Content-Encoding"), 415, -1},
+		{"TTL", testDeviceToken, with("TTL", "3600"), 201, time.Hour},
+		{"zero TTL", testDeviceToken, with("TTL", "0"), 201, 0},
+		{"invalid TTL", testDeviceToken, with("TTL", "an hour"), 201, -1},
+	}
+
+	for _, test := range tests {
+		request, _ := http.NewRequest("POST", server.URL+"/relay-to/production/"+test.deviceToken, strings.NewReader("message"))
+		for name, value := range test.header {
+			request.Header.Set(name, value)
+		}
+
+		before, pushes := time.Now(), len(pusher.pushed())
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+
+		if response.StatusCode != test.status {
+			t.Errorf("%s: got status %d, want %d: %s", test.name, response.StatusCode, test.status, body)
+			continue
+		}
+		if test.status != 201 {
+			if test.deviceToken == badDeviceToken && !strings.Contains(string(body), `"error":"BadDeviceToken"`) {
+				t.Errorf("%s: got body %s, want the APNs reason", test.name, body)
+			}
+			continue
+		}
+
+		notifications := pusher.pushed()[pushes:]
+		if len(notifications) != 1 {
+			t.Fatalf("%s: got %d notifications, want 1", test.name, len(notifications))
+		}
+		expiration := notifications[0].Expiration
+		if test.expires < 0 {
+			if !expiration.IsZero() {
+				t.Errorf("%s: got expiration %v, want none", test.name, expiration)
+			}
+		} else if expiration.Before(before.Add(test.expires)) || expiration.After(time.Now().Add(test.expires)) {
+			t.Errorf("%s: got expiration in %v, want %v", test.name, expiration.Sub(before), test.expires)
+		}
+	}
+}
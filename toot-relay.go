@@ -2,38 +2,217 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
-	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/DagAgren/toot-relay/pkg/z85"
 	"github.com/sideshow/apns2"
 	"github.com/sideshow/apns2/certificate"
 	"github.com/sideshow/apns2/payload"
-	"golang.org/x/net/http2"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/time/rate"
 )
 
 var (
-	developmentClient *apns2.Client
-	productionClient  *apns2.Client
+	topic string
+
+	// maxBodyBytes is the largest request body accepted. Web Push limits messages
+	// to 4096 bytes.
+	maxBodyBytes = 4096
+
+	// maxEncryptionHeaderBytes is the longest Crypto-Key or Encryption header
+	// accepted. The values in them are a 65 byte key and a 16 byte salt, so
+	// real ones are far shorter.
+	maxEncryptionHeaderBytes = 1024
+
+	// defaultAlert is shown until the notification service extension has decrypted
+	// the notification. An empty alert makes notifications silent.
+	defaultAlert = "🎺"
+
+	// alertTitle is shown above the alert, if set.
+	alertTitle = ""
+
+	// silentPush leaves out the alert entirely, for apps that show their own
+	// notification after decrypting it in the background.
+	silentPush = false
+
+	// defaultTTL is used for requests without a TTL header, if set. Otherwise,
+	// such notifications do not expire.
+	defaultTTL = ""
+
+	// maxTTL is the longest TTL accepted, with longer ones shortened to it.
+	maxTTL = apnsMaxTTL
+
+	// forwardVAPID adds the VAPID public key and token that a notification was
+	// sent with to its payload, so that the app can check who sent it.
+	forwardVAPID = false
+
+	// normalPriority is the APNs priority for notifications with normal
+	// urgency, which is also the default when no Urgency header is sent.
+	normalPriority = apns2.PriorityHigh
+
+	// slowPushThreshold is how long a notification may take to send, from when
+	// the request was received, before a warning is logged about it.
+	slowPushThreshold = 2 * time.Second
+
+	// deviceTokenPattern matches valid lowercase hex encoded device tokens. APNs
+	// tokens are currently 64 characters, but Apple does not guarantee this, so
+	// DEVICE_TOKEN_MAX_LEN can make it accept longer ones.
+	deviceTokenPattern = regexp.MustCompile("^[0-9a-f]{64}$")
 )
 
 func main() {
-	p12file := env("P12_FILENAME", "toot-relay.p12")
+	var dryRun bool
+	flag.BoolVar(&dryRun, "dry-run", false, "build and log notifications without sending them, like DRY_RUN=true")
+	flag.Parse()
+
+	// Settings can also be kept in a .env file, which is handy for local
+	// development. Variables set in the environment take precedence.
+	if count, err := loadDotEnv(".env"); err == nil {
+		log.Printf("Loaded %d keys from .env\n", count)
+	} else if !os.IsNotExist(err) {
+		log.Fatal("Error loading .env: ", err)
+	}
+
+	p12file := env("P12_CERT_FILE", env("P12_FILENAME", "toot-relay.p12"))
 	p12base64 := env("P12_BASE64", "")
-	p12password := env("P12_PASSWORD", "")
+	p12password := env("P12_CERT_PASSWORD", env("P12_PASSWORD", ""))
+
+	// Token based authentication is used instead of the p12 certificate if any of
+	// P8_PRIVATE_KEY, P8_PRIVATE_KEY_FILE, P8_KEY_ID or P8_TEAM_ID are set.
+	p8Key := env("P8_PRIVATE_KEY", "")
+	p8KeyFile := env("P8_PRIVATE_KEY_FILE", "")
+	p8KeyID := env("P8_KEY_ID", "")
+	p8TeamID := env("P8_TEAM_ID", "")
+	useToken := p8Key != "" || p8KeyFile != "" || p8KeyID != "" || p8TeamID != ""
+
+	var err error
+	logger, err = newLogger(os.Stderr, env("LOG_FORMAT", "json"), env("LOG_LEVEL", "info"))
+	if err != nil {
+		log.Fatal("Invalid logging configuration: ", err)
+	}
+	logTokenMode = env("LOG_TOKEN_MODE", logTokenMode)
+	if logTokenMode != "full" && logTokenMode != "redacted" && logTokenMode != "hashed" {
+		log.Fatal("Invalid LOG_TOKEN_MODE: ", logTokenMode)
+	}
+
+	// APNS_TOPIC is the bundle ID of the app to push to. It can be overridden per
+	// request with the Topic-Bundle header.
+	topic = env("APNS_TOPIC", "cx.c3.toot")
+	defaultAlert = env("APNS_ALERT_BODY", env("DEFAULT_ALERT", defaultAlert))
+	alertTitle = env("APNS_ALERT_TITLE", "")
+	silentPush = env("APNS_CONTENT_AVAILABLE_ONLY", env("SILENT_PUSH", "")) == "true"
+	dryRun = dryRun || env("DRY_RUN", "") == "true"
+	fallbackEnvironment = env("APNS_FALLBACK_ENVIRONMENT", "") == "true"
+	decompressBodies = env("DECOMPRESS_BODIES", "") == "true"
+	forwardVAPID = env("FORWARD_VAPID", "") == "true"
+	normalPriority = envInt("NORMAL_URGENCY_PRIORITY", normalPriority)
+	if normalPriority != apns2.PriorityLow && normalPriority != apns2.PriorityHigh {
+		log.Fatal("NORMAL_URGENCY_PRIORITY must be 5 or 10")
+	}
+	invalidationWebhookURL = env("INVALID_TOKEN_WEBHOOK", env("INVALIDATION_WEBHOOK_URL", ""))
+	invalidationWebhookSecret = env("INVALIDATION_WEBHOOK_SECRET", "")
+	batchConcurrency = envInt("BATCH_CONCURRENCY", batchConcurrency)
+	if batchConcurrency < 1 {
+		log.Fatal("BATCH_CONCURRENCY must be at least 1")
+	}
+	maxTTL = envInt("MAX_TTL", maxTTL)
+	if maxTTL > apnsMaxTTL {
+		log.Fatal("MAX_TTL can not be longer than the APNs maximum of ", apnsMaxTTL)
+	}
+	if ttl := env("DEFAULT_TTL", ""); ttl != "" {
+		defaultTTL = strconv.Itoa(envInt("DEFAULT_TTL", 0))
+	}
+	maxBodyBytes = envInt("MAX_BODY_BYTES", maxBodyBytes)
+	maxEncryptionHeaderBytes = envInt("MAX_ENCRYPTION_HEADER_BYTES", maxEncryptionHeaderBytes)
+
+	if maxLength := env("DEVICE_TOKEN_MAX_LEN", ""); maxLength != "" {
+		length, err := strconv.Atoi(maxLength)
+		if err != nil || length < 64 {
+			log.Fatal("Invalid DEVICE_TOKEN_MAX_LEN: ", maxLength)
+		}
+		deviceTokenPattern = regexp.MustCompile(fmt.Sprintf("^[0-9a-f]{64,%d}$", length))
+	}
+
+	maxPushRetries = envInt("PUSH_MAX_RETRIES", envInt("MAX_PUSH_RETRIES", maxPushRetries))
+	retryBaseDelay = time.Duration(envInt("RETRY_BASE_DELAY_MS", 100)) * time.Millisecond
+	maxRetryDelay = envDuration("MAX_RETRY_DELAY", maxRetryDelay)
+	pushTimeout = envDuration("PUSH_TIMEOUT", time.Duration(envInt("APNS_PUSH_TIMEOUT_SECONDS", 10))*time.Second)
+	if pushTimeout <= 0 {
+		log.Fatal("PUSH_TIMEOUT and APNS_PUSH_TIMEOUT_SECONDS must be positive")
+	}
+	slowPushThreshold = time.Duration(envInt("SLOW_PUSH_THRESHOLD_MS", 2000)) * time.Millisecond
 
 	port := env("PORT", "42069")
-	tlsCrtFile := env("CRT_FILENAME", "toot-relay.crt")
-	tlsKeyFile := env("KEY_FILENAME", "toot-relay.key")
+	if number, err := strconv.Atoi(port); err != nil || number < 1 || number > 65535 {
+		log.Fatal("Invalid PORT: ", port)
+	}
+
+	// With SOCKET_PATH, the TCP port is only listened on as well if PORT
+	// is set explicitly.
+	socketPath := env("SOCKET_PATH", "")
+	_, portIsSet := os.LookupEnv("PORT")
+	listenTCP := socketPath == "" || portIsSet
+
+	// CERT_FILE and KEY_FILE, or TLS_CERT_FILE and TLS_KEY_FILE, explicitly enable TLS,
+	// and must be set together. Otherwise,
+	// TLS is used if the file named by CRT_FILENAME exists.
+	tlsCrtFile := env("TLS_CERT_FILE", env("CERT_FILE", ""))
+	tlsKeyFile := env("TLS_KEY_FILE", env("KEY_FILE", ""))
+	useTLS := tlsCrtFile != ""
+	if (tlsCrtFile == "") != (tlsKeyFile == "") {
+		log.Fatal("CERT_FILE and KEY_FILE must both be set to enable TLS")
+	}
+	if !useTLS {
+		tlsCrtFile = env("CRT_FILENAME", "toot-relay.crt")
+		tlsKeyFile = env("KEY_FILENAME", "toot-relay.key")
+		if _, err := os.Stat(tlsCrtFile); !os.IsNotExist(err) {
+			useTLS = true
+		}
+	}
+
+	// ACME_DOMAIN and ACME_EMAIL instead fetch and renew a certificate automatically.
+	acmeDomain := env("ACME_DOMAIN", "")
+	acmeEmail := env("ACME_EMAIL", "")
+	var acmeManager *autocert.Manager
+	if acmeDomain != "" || acmeEmail != "" {
+		if acmeDomain == "" || acmeEmail == "" {
+			log.Fatal("ACME_DOMAIN and ACME_EMAIL must both be set to use ACME")
+		}
+		if useTLS {
+			log.Fatal("CERT_FILE and ACME_DOMAIN can not both be set")
+		}
+
+		acmeManager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(acmeDomain),
+			Email:      acmeEmail,
+			Cache:      autocert.DirCache(env("ACME_CACHE_DIR", "acme-cache")),
+		}
+	}
+
 	// CA_FILENAME can be set to a file that contains PEM encoded certificates that will be
 	// used as the sole root CAs when connecting to the Apple Notification Service API.
 	// If unset, the system-wide certificate store will be used.
@@ -47,141 +226,896 @@ func main() {
 		}
 	}
 
-	if p12base64 != "" {
-		bytes, err := base64.StdEncoding.DecodeString(p12base64)
-		if err != nil {
-			log.Fatal("Base64 decoding error: ", err)
+	// These are used by apns2 when creating clients.
+	apns2.HTTPClientTimeout = envDuration("APNS_HTTP_TIMEOUT", apns2.HTTPClientTimeout)
+	apns2.TCPKeepAlive = envDuration("APNS_TCP_KEEPALIVE", apns2.TCPKeepAlive)
+
+	// BACKEND selects where notifications are sent: APNs for iOS, or Firebase
+	// Cloud Messaging for Android.
+	var developmentClient, productionClient *apns2.Client
+	var p8 signingKey
+	relay := newRelayServer(clientPair{})
+	relay.dryRun = dryRun
+	switch backend := env("BACKEND", "apns"); backend {
+	case "fcm":
+		if env("FCM_SERVER_KEY", "") != "" {
+			log.Fatal("FCM_SERVER_KEY is only supported by the retired legacy FCM API, set FCM_CREDENTIALS_FILE instead")
 		}
 
-		cert, err := certificate.FromP12Bytes(bytes, p12password)
+		fcmPusher, err = newFCMClient(requireEnv("FCM_CREDENTIALS_FILE"), env("FCM_PROJECT_ID", ""))
 		if err != nil {
-			log.Fatal("Error parsing certificate: ", err)
+			log.Fatal("Error loading FCM_CREDENTIALS_FILE: ", err)
+		}
+		relay.clients = clientPair{development: fcmPusher, production: fcmPusher}
+	case "apns":
+		// Nothing is sent in a dry run, so there is no need for credentials.
+		if _, err := os.Stat(p12file); dryRun && !useToken && p12base64 == "" && os.IsNotExist(err) {
+			log.Println("No APNs credentials configured, which is only fine for a dry run")
+			break
 		}
 
-		developmentClient = apns2.NewClient(cert).Development()
-		productionClient = apns2.NewClient(cert).Production()
-	} else {
-		cert, err := certificate.FromP12File(p12file, p12password)
+		if useToken {
+			if env("P12_CERT_FILE", "") != "" || p12base64 != "" {
+				log.Fatal("Both a P8 signing key and a P12 certificate are configured, set only one")
+			}
+
+			if p8Key == "" && p8KeyFile == "" {
+				log.Fatal("P8_PRIVATE_KEY or P8_PRIVATE_KEY_FILE must be set")
+			}
+			if p8Key != "" && p8KeyFile != "" {
+				log.Println("Both P8_PRIVATE_KEY and P8_PRIVATE_KEY_FILE are set, ignoring P8_PRIVATE_KEY_FILE")
+			}
+
+			p8 = signingKey{
+				key:     p8Key,
+				keyFile: p8KeyFile,
+				keyID:   requireEnv("P8_KEY_ID"),
+				teamID:  requireEnv("P8_TEAM_ID"),
+			}
+			authToken, err := p8.authToken()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			developmentClient = apns2.NewTokenClient(authToken).Development()
+			productionClient = apns2.NewTokenClient(authToken).Production()
+		} else if p12base64 != "" {
+			bytes, err := base64.StdEncoding.DecodeString(p12base64)
+			if err != nil {
+				log.Fatal("Base64 decoding error: ", err)
+			}
+
+			cert, err := certificate.FromP12Bytes(bytes, p12password)
+			if err != nil {
+				log.Fatal("Error parsing certificate: ", err)
+			}
+
+			developmentClient = apns2.NewClient(cert).Development()
+			productionClient = apns2.NewClient(cert).Production()
+		} else {
+			cert, err := certificate.FromP12File(p12file, p12password)
+			if err != nil {
+				log.Fatal("Error loading certificate file: ", err)
+			}
+
+			developmentClient = apns2.NewClient(cert).Development()
+			productionClient = apns2.NewClient(cert).Production()
+		}
+
+		configureClient(developmentClient, rootCAs)
+		configureClient(productionClient, rootCAs)
+		relay.clients = clientPair{development: developmentClient, production: productionClient}
+
+		if configFile := env("APNS_CONFIG_FILE", env("APPS_CONFIG", "")); configFile != "" {
+			if relay.apps, err = loadAppConfig(configFile, rootCAs); err != nil {
+				log.Println("Error loading APNS_CONFIG_FILE:", err)
+			}
+		}
+	default:
+		log.Fatal("Unknown BACKEND: ", backend)
+	}
+
+	if dryRun {
+		log.Println("DRY RUN: notifications are built and logged, but none are sent")
+	}
+
+	shutdownTimeout := envDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+
+	if seconds := env("SHUTDOWN_TIMEOUT_SECONDS", ""); seconds != "" {
+		timeout, err := strconv.Atoi(seconds)
+		if err != nil || timeout < 0 {
+			log.Fatal("Invalid SHUTDOWN_TIMEOUT_SECONDS: ", seconds)
+		}
+		shutdownTimeout = time.Duration(timeout) * time.Second
+	}
+
+	readyDelay := envDuration("SHUTDOWN_READY_DELAY", 0)
+
+	authFailureThreshold = int64(envInt("HEALTHZ_AUTH_FAILURE_THRESHOLD", 0))
+	relay.breaker = newCircuitBreaker(envInt("CIRCUIT_BREAKER_FAILURES", 5), time.Duration(envInt("CIRCUIT_BREAKER_TIMEOUT_SECONDS", 30))*time.Second)
+	if relay.breaker.timeout < 0 {
+		log.Fatal("CIRCUIT_BREAKER_TIMEOUT_SECONDS can not be negative")
+	}
+
+	if perToken := rate.Limit(envFloat("RATE_LIMIT_PER_TOKEN", 2)); perToken != 0 {
+		relay.limiter = newRateLimiter(perToken, envInt("RATE_LIMIT_BURST", 5), envInt("RATE_LIMIT_MAX_TOKENS", 10000))
+		if relay.limiter.maxTokens < 1 {
+			log.Fatal("RATE_LIMIT_MAX_TOKENS must be at least 1")
+		}
+		go relay.limiter.collect(time.Hour)
+	}
+
+	if size := envInt("DEDUP_CACHE_SIZE", 10000); size > 0 {
+		relay.sent = newDedupCache(size)
+	}
+
+	if env("PUSH_QUEUE", "") == "true" {
+		relay.startPushWorkers(envInt("QUEUE_DEPTH", 1000), envInt("WORKER_COUNT", 10))
+	} else if maxPushes := envInt("MAX_CONCURRENT_PUSHES", 0); maxPushes > 0 {
+		relay.pushSlots = make(chan struct{}, maxPushes)
+	}
+
+	healthzPushCheck := env("HEALTHZ_PUSH_CHECK", "") == "true"
+	var healthzCanaryToken string
+	if healthzPushCheck {
+		healthzCanaryToken = requireEnv("HEALTHZ_CANARY_TOKEN")
+	}
+
+	// Spans are exported following the OpenTelemetry conventions for
+	// configuring exporters, though only in the OTLP/HTTP JSON encoding.
+	tracesEndpoint := env("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	if endpoint := env("OTEL_EXPORTER_OTLP_ENDPOINT", ""); tracesEndpoint == "" && endpoint != "" {
+		tracesEndpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	if tracesEndpoint != "" {
+		if protocol := env("OTEL_EXPORTER_OTLP_PROTOCOL", "http/json"); protocol != "http/json" {
+			log.Println("Ignoring OTEL_EXPORTER_OTLP_PROTOCOL", protocol, "as spans are only exported as http/json")
+		}
+		exporter = newSpanExporter(tracesEndpoint, env("OTEL_SERVICE_NAME", "toot-relay"))
+		log.Println("Exporting spans to", tracesEndpoint)
+	}
+
+	// The Authorization header carries VAPID tokens too, so only one of them
+	// can be required.
+	authToken := env("RELAY_AUTH_TOKEN", "")
+	allowedKeys := env("VAPID_ALLOWED_KEYS", "")
+	allowedOrigins := env("ALLOWED_ORIGINS", "")
+	if authToken != "" && allowedKeys != "" {
+		log.Fatal("RELAY_AUTH_TOKEN and VAPID_ALLOWED_KEYS can not both be set")
+	}
+
+	// authorized wraps handlers for the relay endpoints in the checks that are
+	// configured. Only the bearer token applies to GET requests, which merely
+	// describe the registration.
+	authorized := func(next http.HandlerFunc, forPush bool) http.HandlerFunc {
+		if forPush && allowedKeys != "" {
+			next = withVAPID(strings.Split(allowedKeys, ","), env("VAPID_AUDIENCE", ""), next)
+		}
+		if forPush {
+			next = withAllowedOrigins(strings.Split(allowedOrigins, ","), env("ALLOWED_ORIGINS_HEADER", "Origin"), next)
+		}
+		return withBearerToken(authToken, next)
+	}
+
+	mux := http.NewServeMux()
+	relay.route(mux, env("CORS_ALLOW_ORIGIN", "*"), authorized)
+	mux.HandleFunc("/metrics", relay.metricsHandler(env("METRICS_TOKEN", "")))
+	mux.HandleFunc("/stats", relay.statsHandler(env("METRICS_TOKEN", "")))
+	mux.HandleFunc("/healthz", probeMethods(healthzHandler(relay.productionClient, healthzPushCheck, healthzCanaryToken)))
+	mux.HandleFunc("/health", probeMethods(healthHandler(relay.productionClient, 10*time.Second)))
+	mux.HandleFunc("/livez", probeMethods(livezHandler))
+	mux.HandleFunc("/readyz", probeMethods(relay.readyzHandler))
+
+	// Only P8 signing keys can be reloaded, as certificates are replaced less
+	// often and the relay is restarted for those.
+	if adminToken := env("ADMIN_TOKEN", ""); adminToken != "" && p8.keyID != "" {
+		mux.HandleFunc("/admin/reload-key", withRequestID(withBearerToken(adminToken, reloadKeyHandler(relay, p8, rootCAs))))
+	} else if adminToken != "" {
+		log.Println("ADMIN_TOKEN is set, but only P8 signing keys can be reloaded")
+	}
+
+	if env("DEBUG_ENDPOINTS", "") == "true" {
+		log.Println("Debug endpoints are enabled, do not expose them publicly")
+		mux.HandleFunc("/encode", withRequestID(withRecover(authorized(encodeHandler, false))))
+	}
+
+	server := newServer(listenAddress(env("BIND_ADDRESS", ""), port), mux)
+	log.Printf("Timeouts: read %v, write %v, idle %v, push %v\n", server.ReadTimeout, server.WriteTimeout, server.IdleTimeout, pushTimeout)
+
+	go waitUntilReady(productionClient, 5*time.Second)
+
+	if acmeManager != nil {
+		server.TLSConfig = restrictTLS(acmeManager.TLSConfig())
+	} else if useTLS {
+		server.TLSConfig = restrictTLS(&tls.Config{})
+	}
+
+	if socketPath != "" {
+		listener, err := listenUnix(socketPath)
 		if err != nil {
-			log.Fatal("Error loading certificate file: ", err)
+			log.Fatal("Error listening on SOCKET_PATH: ", err)
 		}
+		log.Println("Listening on", socketPath)
 
-		developmentClient = apns2.NewClient(cert).Development()
-		productionClient = apns2.NewClient(cert).Production()
+		go func() {
+			if err := server.Serve(listener); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
 	}
 
-	if rootCAs != nil {
-		developmentClient.HTTPClient.Transport.(*http2.Transport).TLSClientConfig.RootCAs = rootCAs
-		productionClient.HTTPClient.Transport.(*http2.Transport).TLSClientConfig.RootCAs = rootCAs
+	if listenTCP {
+		go func() {
+			var err error
+			if acmeManager != nil {
+				err = server.ListenAndServeTLS("", "")
+			} else if useTLS {
+				err = server.ListenAndServeTLS(tlsCrtFile, tlsKeyFile)
+			} else {
+				err = server.ListenAndServe()
+			}
+
+			if err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
 	}
 
-	http.HandleFunc("/relay-to/", handler)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
 
-	if _, err := os.Stat("toot-relay.crt"); !os.IsNotExist(err) {
-		log.Fatal(http.ListenAndServeTLS(":"+port, tlsCrtFile, tlsKeyFile, nil))
-	} else {
-		log.Fatal(http.ListenAndServe(":"+port, nil))
+	// Failing /readyz for a while first lets load balancers move traffic
+	// elsewhere before connections are refused.
+	draining.Store(true)
+	if readyDelay > 0 {
+		log.Printf("Waiting %v before shutting down\n", readyDelay)
+		time.Sleep(readyDelay)
+	}
+	shuttingDown.Store(true)
+
+	log.Printf("Shutting down, draining %d connections\n", atomic.LoadInt64(&activeConnections))
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Shutdown error:", err)
+	}
+
+	if relay.queue != nil {
+		log.Printf("Waiting for %d queued notifications\n", len(relay.queue.jobs))
+		if err := relay.queue.drain(ctx); err != nil {
+			log.Println("Error draining push queue:", err)
+		}
+	}
+
+	if exporter != nil {
+		if err := exporter.stop(ctx); err != nil {
+			log.Println("Error exporting spans:", err)
+		}
 	}
 }
 
-func handler(writer http.ResponseWriter, request *http.Request) {
-	components := strings.Split(request.URL.Path, "/")
+// listenAddress joins the address set by BIND_ADDRESS and the port. IPv6
+// addresses may be given with or without brackets.
+func listenAddress(bindAddress, port string) string {
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(bindAddress, "["), "]"), port)
+}
 
-	if len(components) < 4 {
-		writer.WriteHeader(500)
-		fmt.Fprintln(writer, "Invalid URL path:", request.URL.Path)
-		log.Println("Invalid URL path:", request.URL.Path)
+// newServer returns a server for handler on addr, with the timeouts set by
+// HTTP_READ_TIMEOUT, HTTP_WRITE_TIMEOUT and HTTP_IDLE_TIMEOUT. The write
+// timeout also bounds how long a push may take, including retries, so it is
+// longer than the 30 seconds of the read timeout: four attempts of up to
+// PUSH_TIMEOUT each, and the waits between them, would not fit.
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ConnState:    trackConnState,
+		ReadTimeout:  envDuration("HTTP_READ_TIMEOUT", 30*time.Second),
+		WriteTimeout: envDuration("HTTP_WRITE_TIMEOUT", 2*time.Minute),
+		IdleTimeout:  envDuration("HTTP_IDLE_TIMEOUT", 2*time.Minute),
+	}
+}
+
+// listenUnix listens on a UNIX domain socket at path, which only the owner and
+// group may connect to. A socket left over from an earlier run is replaced. The
+// socket is removed again when the listener is closed on shutdown.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// activeConnections counts the connections which are currently open, so that
+// shutdown can report how many it is waiting for.
+var activeConnections int64
+
+func trackConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&activeConnections, 1)
+	case http.StateHijacked, http.StateClosed:
+		atomic.AddInt64(&activeConnections, -1)
+	}
+}
+
+// apnsMaxPayloadBytes is the largest payload APNs accepts for a notification.
+const apnsMaxPayloadBytes = 4096
+
+// apnsMaxCollapseIDBytes is the longest collapse ID accepted by APNs.
+const apnsMaxCollapseIDBytes = 64
+
+// collapseIDPattern matches the Topic headers that are passed on as collapse
+// IDs. Web Push limits topics to base64url characters, and dots are allowed as
+// well.
+var collapseIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// apnsMaxTTL is the longest APNs will store a notification for, 28 days.
+const apnsMaxTTL = 2419200
+
+// bodyBuffers holds buffers for reading request bodies into, to be reused by
+// later requests.
+var bodyBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// withOctetStream only lets requests through to next whose body is opaque
+// bytes, as Web Push requires, with Content-Type application/octet-stream or
+// none at all. Anything else would be relayed as garbled ciphertext.
+func withOctetStream(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		contentType, _, _ := strings.Cut(request.Header.Get("Content-Type"), ";")
+		contentType = strings.TrimSpace(contentType)
+		if contentType != "" && !strings.EqualFold(contentType, "application/octet-stream") {
+			writer.WriteHeader(415)
+			fmt.Fprintln(writer, "Unsupported Content-Type:", contentType)
+			logger.WarnContext(request.Context(), "Unsupported Content-Type", "content_type", contentType)
+			return
+		}
+
+		next(writer, request)
+	}
+}
+
+func (s *relayServer) handler(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	start := time.Now()
+	appTopic, isApp := appTopics[request.PathValue("app")]
+
+	deviceToken, err := normalizeDeviceToken(request.PathValue("token"))
+	if err != nil {
+		writer.WriteHeader(400)
+		fmt.Fprintln(writer, "Invalid device token:", err)
+		logger.WarnContext(ctx, "Invalid device token", "error", err)
 		return
 	}
 
-	isProduction := components[2] == "production"
+	if s.limiter != nil {
+		if allowed, delay := s.limiter.allow(deviceToken); !allowed {
+			writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			writer.WriteHeader(429)
+			fmt.Fprintln(writer, "Too many notifications for this device token")
+			logger.WarnContext(ctx, "Rate limited", "device_token", redactToken(deviceToken), "retry_after_ms", delay.Milliseconds())
+			return
+		}
+	}
+
+	isProduction := request.PathValue("environment") == "production"
+	setSpanAttribute(ctx, "device_token_prefix", deviceToken[:min(8, len(deviceToken))])
 
 	notification := &apns2.Notification{}
-	notification.DeviceToken = components[3]
+	notification.DeviceToken = deviceToken
+	requestLog := logger.With("device_token", redactToken(notification.DeviceToken))
+
+	var body io.Reader = http.MaxBytesReader(writer, request.Body, int64(maxBodyBytes))
+	contentEncoding := request.Header.Get("Content-Encoding")
+	if decompressBodies {
+		var decompressed io.Reader
+		if decompressed, contentEncoding, err = decompressBody(body, contentEncoding); err != nil {
+			writer.WriteHeader(400)
+			fmt.Fprintln(writer, "Error decompressing request body:", err)
+			requestLog.WarnContext(ctx, "Error decompressing request body", "error", err)
+			return
+		}
+		if decompressed != body {
+			// The decompressed message must fit the limit too.
+			body = http.MaxBytesReader(writer, io.NopCloser(decompressed), int64(maxBodyBytes))
+		}
+	}
+
+	setSpanAttribute(ctx, "content_encoding", contentEncoding)
+
+	// aes128gcm messages need to be split up before encoding, but others are
+	// encoded as they are read.
+	buffer := bodyBuffers.Get().(*bytes.Buffer)
+	buffer.Reset()
+	defer bodyBuffers.Put(buffer)
+	var encoded strings.Builder
+	if contentEncoding == "aes128gcm" {
+		_, err = buffer.ReadFrom(body)
+	} else {
+		// Content-Length is up to the client, so it is only trusted as far
+		// as the body could be read.
+		encoded.Grow(z85.EncodedLen(int(min(max(request.ContentLength, 0), int64(maxBodyBytes)))))
+		encoder := z85.NewEncoder(&encoded)
+		if _, err = io.Copy(encoder, body); err == nil {
+			err = encoder.Close()
+		}
+	}
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writer.WriteHeader(413)
+			fmt.Fprintln(writer, "Request body larger than", maxBodyBytes, "bytes")
+			requestLog.WarnContext(ctx, "Request body too large")
+		} else {
+			writer.WriteHeader(400)
+			fmt.Fprintln(writer, "Error reading request body:", err)
+			requestLog.WarnContext(ctx, "Error reading request body", "error", err)
+		}
+		return
+	}
+
+	payload := payload.NewPayload().MutableContent().ContentAvailable().Custom("p", encoded.String())
+
+	// Notifications that show nothing to the user must be sent with the
+	// background push type, and anything else as alert.
+	pushType := pushTypeBackground
+
+	alert := defaultAlert
+	if values, isPresent := request.Header["Alert"]; isPresent {
+		alert = values[0]
+	}
+	// An alert of "" with the quotes included is also treated as empty, as
+	// empty headers tend to get lost along the way.
+	if alert == `""` {
+		alert = ""
+	}
+	if alertTitle != "" && !silentPush {
+		payload.AlertTitle(alertTitle)
+		if alert != "" {
+			payload.AlertBody(alert)
+		}
+		pushType = pushTypeAlert
+	} else if alert != "" && !silentPush {
+		payload.Alert(alert)
+		pushType = pushTypeAlert
+	}
+
+	if value := request.Header.Get("Badge"); value != "" {
+		if badge, err := strconv.Atoi(value); err == nil && badge >= 0 {
+			payload.Badge(badge)
+			pushType = pushTypeAlert
+		} else {
+			requestLog.WarnContext(ctx, "Ignoring invalid Badge header", "badge", value)
+		}
+	}
 
-	buffer := new(bytes.Buffer)
-	buffer.ReadFrom(request.Body)
-	encodedString := encode85(buffer.Bytes())
-	payload := payload.NewPayload().Alert("🎺").MutableContent().ContentAvailable().Custom("p", encodedString)
+	if sound := request.Header.Get("Sound"); strings.HasPrefix(sound, "{") {
+		var critical struct {
+			Name   string   `json:"name"`
+			Volume *float32 `json:"volume"`
+		}
+		if err := json.Unmarshal([]byte(sound), &critical); err == nil {
+			if critical.Name == "" {
+				critical.Name = "default"
+			}
+			payload.SoundName(critical.Name)
+			if critical.Volume != nil {
+				payload.SoundVolume(*critical.Volume)
+			}
+			pushType = pushTypeAlert
+		} else {
+			requestLog.WarnContext(ctx, "Ignoring invalid Sound header", "sound", sound, "error", err)
+		}
+	} else if sound != "" {
+		payload.Sound(sound)
+		pushType = pushTypeAlert
+	}
+
+	if values, isPresent := request.Header["Thread-Id"]; isPresent {
+		threadID := strings.TrimSpace(values[0])
+		if threadID == "" {
+			writer.WriteHeader(400)
+			fmt.Fprintln(writer, "Thread-Id header must not be empty")
+			requestLog.WarnContext(ctx, "Empty Thread-Id header")
+			return
+		}
+		payload.ThreadID(threadID)
+	}
 
-	if len(components) > 4 {
-		payload.Custom("x", strings.Join(components[4:], "/"))
+	if extra := request.PathValue("extra"); extra != "" {
+		payload.Custom("x", extra)
+	}
+
+	if forwardVAPID {
+		for name, value := range vapidFields(request) {
+			payload.Custom(name, value)
+		}
 	}
 
 	notification.Payload = payload
-	notification.Topic = "cx.c3.toot"
+	notification.Topic = topic
+	if isApp {
+		notification.Topic = appTopic
+	}
+
+	if bundle := request.Header.Get("Topic-Bundle"); bundle != "" {
+		notification.Topic = bundle
+	}
 
-	switch request.Header.Get("Content-Encoding") {
+	if notification.Topic == "" {
+		writer.WriteHeader(400)
+		fmt.Fprintln(writer, "No APNs topic configured or given in Topic-Bundle header")
+		requestLog.WarnContext(ctx, "Missing APNs topic")
+		return
+	}
+
+	switch contentEncoding {
 	case "aesgcm":
+		if err := checkEncryptionHeaders(request.Header); err != nil {
+			writer.WriteHeader(400)
+			fmt.Fprintln(writer, err)
+			requestLog.WarnContext(ctx, "Encryption header too long", "error", err)
+			return
+		}
+
 		if publicKey, err := encodedValue(request.Header, "Crypto-Key", "dh"); err == nil {
 			payload.Custom("k", publicKey)
 		} else {
-			writer.WriteHeader(500)
+			writer.WriteHeader(400)
 			fmt.Fprintln(writer, "Error retrieving public key:", err)
-			log.Println("Error retrieving public key:", err)
+			requestLog.WarnContext(ctx, "Error retrieving public key", "error", err)
 			return
 		}
 
 		if salt, err := encodedValue(request.Header, "Encryption", "salt"); err == nil {
 			payload.Custom("s", salt)
 		} else {
-			writer.WriteHeader(500)
+			writer.WriteHeader(400)
 			fmt.Fprintln(writer, "Error retrieving salt:", err)
-			log.Println("Error retrieving salt:", err)
+			requestLog.WarnContext(ctx, "Error retrieving salt", "error", err)
+			return
+		}
+	case "aes128gcm":
+		salt, publicKey, ciphertext, err := parseAES128GCMHeader(buffer.Bytes())
+		if err != nil {
+			writer.WriteHeader(400)
+			fmt.Fprintln(writer, "Error parsing aes128gcm header:", err)
+			requestLog.ErrorContext(ctx, "Error parsing aes128gcm header", "error", err)
 			return
 		}
-	//case "aes128gcm": // No further headers needed. However, not implemented on client side so return 415.
+
+		payload.Custom("p", z85.Encode(ciphertext))
+		payload.Custom("as", z85.Encode(salt))
+		payload.Custom("ak", z85.Encode(publicKey))
+		payload.Custom("e", "aes128gcm")
 	default:
 		writer.WriteHeader(415)
 		fmt.Fprintln(writer, "Unsupported Content-Encoding:", request.Header.Get("Content-Encoding"))
-		log.Println("Unsupported Content-Encoding:", request.Header.Get("Content-Encoding"))
+		requestLog.ErrorContext(ctx, "Unsupported Content-Encoding", "content_encoding", request.Header.Get("Content-Encoding"))
 		return
 	}
 
-	if seconds := request.Header.Get("TTL"); seconds != "" {
-		if ttl, err := strconv.Atoi(seconds); err == nil {
+	seconds := request.Header.Get("TTL")
+	if seconds == "" {
+		seconds = defaultTTL
+	}
+	setSpanAttribute(ctx, "ttl", seconds)
+	if seconds != "" {
+		ttl, err := strconv.Atoi(seconds)
+		if errors.Is(err, strconv.ErrRange) {
+			// Values too large to parse are out of bounds either way.
+			ttl, err = maxTTL+1, nil
+			if strings.HasPrefix(seconds, "-") {
+				ttl = -1
+			}
+		}
+
+		if err != nil {
+			requestLog.WarnContext(ctx, "Ignoring invalid TTL header", "ttl", seconds)
+		} else {
+			if ttl < 0 {
+				requestLog.WarnContext(ctx, "Treating negative TTL as zero", "ttl", seconds)
+				ttl = 0
+			}
+
+			if ttl > maxTTL {
+				requestLog.WarnContext(ctx, "Clamping TTL to the maximum", "ttl", seconds, "max_ttl", maxTTL)
+				ttl = maxTTL
+			}
+
+			// A TTL of zero expires immediately, so APNs will only
+			// try to deliver the notification once.
 			notification.Expiration = time.Now().Add(time.Duration(ttl) * time.Second)
 		}
 	}
 
 	if topic := request.Header.Get("Topic"); topic != "" {
+		if !collapseIDPattern.MatchString(topic) {
+			writer.WriteHeader(400)
+			fmt.Fprintln(writer, "Topic must match", collapseIDPattern)
+			requestLog.WarnContext(ctx, "Invalid Topic header", "topic", topic)
+			return
+		}
+		if len(topic) > apnsMaxCollapseIDBytes {
+			requestLog.WarnContext(ctx, "Truncating Topic to the maximum collapse ID length", "topic_bytes", len(topic))
+			topic = topic[:apnsMaxCollapseIDBytes]
+		}
 		notification.CollapseID = topic
 	}
 
-	switch request.Header.Get("Urgency") {
+	setSpanAttribute(ctx, "urgency", request.Header.Get("Urgency"))
+	switch urgency := request.Header.Get("Urgency"); urgency {
 	case "very-low", "low":
 		notification.Priority = apns2.PriorityLow
-	default:
+	case "high":
 		notification.Priority = apns2.PriorityHigh
+	case "normal", "":
+		notification.Priority = normalPriority
+	default:
+		requestLog.WarnContext(ctx, "Ignoring invalid Urgency header", "urgency", urgency)
+		notification.Priority = normalPriority
 	}
+	// APNs rejects background notifications sent with high priority.
+	if pushType == pushTypeBackground {
+		notification.Priority = apns2.PriorityLow
+	}
+	ctx = context.WithValue(ctx, pushTypeKey, pushType)
 
-	var client *apns2.Client
-	if isProduction {
-		client = productionClient
-	} else {
-		client = developmentClient
+	if encoded, err := json.Marshal(payload); err == nil && len(encoded) > apnsMaxPayloadBytes {
+		writer.WriteHeader(413)
+		fmt.Fprintln(writer, "Notification payload of", len(encoded), "bytes is too large for APNs")
+		requestLog.WarnContext(ctx, "Notification payload too large", "payload_bytes", len(encoded))
+		return
 	}
 
-	res, err := client.Push(notification)
-	if err != nil {
-		writer.WriteHeader(500)
-		fmt.Fprintln(writer, "Push error:", err)
-		log.Println("Push error:", err)
+	clients := s.clientsFor(notification.Topic)
+	client := clients.forEnvironment(isProduction)
+	if fcmPusher == nil {
+		if fallbackEnvironment {
+			client = fallbackPusher{
+				primary:      client,
+				fallback:     clients.forEnvironment(!isProduction),
+				fallbackName: environmentName(!isProduction),
+			}
+		}
+		requestLog = requestLog.With("environment", environmentName(isProduction))
+	}
+
+	requestLog = requestLog.With(
+		"priority", notification.Priority,
+		"push_type", pushType,
+		"collapse_id", notification.CollapseID,
+		"expiration", notification.Expiration)
+
+	if s.sent != nil {
+		if apnsID, sent := s.sent.lookup(notification); sent {
+			setSpanAttribute(ctx, "apns_id", apnsID)
+			s.metrics.pushTotal.inc("duplicate")
+			requestLog.InfoContext(ctx, "Notification already sent", "apns_id", apnsID)
+			writer.Header().Add("Location", messageLocation(apnsID))
+			writer.Header().Set("Content-Type", "application/json")
+			writer.WriteHeader(201)
+			json.NewEncoder(writer).Encode(map[string]interface{}{"apns_id": apnsID})
+			return
+		}
+	}
+
+	if s.dryRun || request.Header.Get("X-Dry-Run") == "true" {
+		requestLog.InfoContext(ctx, "Dry run, not sending notification", "topic", notification.Topic, "payload", notification.Payload)
+		writer.Header().Set("Content-Type", "application/json")
+		// A relay in dry run answers as if the notification was sent, so that
+		// senders can be tested against it, while a single request asking for
+		// a dry run is told that nothing was sent.
+		if s.dryRun {
+			writer.WriteHeader(201)
+		} else {
+			writer.WriteHeader(202)
+		}
+		json.NewEncoder(writer).Encode(map[string]interface{}{
+			"device_token": notification.DeviceToken,
+			"topic":        notification.Topic,
+			"priority":     notification.Priority,
+			"push_type":    pushType,
+			"collapse_id":  notification.CollapseID,
+			"expiration":   notification.Expiration,
+			"payload":      notification.Payload,
+		})
 		return
 	}
 
-	if res.Sent() {
-		writer.Header().Add("Location", fmt.Sprintf("https://not-supported/%v", res.ApnsID))
+	if s.queue != nil {
+		job := pushJob{
+			ctx:          context.WithoutCancel(ctx),
+			start:        start,
+			client:       client,
+			notification: notification,
+			log:          requestLog,
+		}
+
+		if err := s.queue.enqueue(job); err != nil {
+			writer.Header().Set("Retry-After", "5")
+			writer.WriteHeader(503)
+			fmt.Fprintln(writer, err)
+			requestLog.WarnContext(ctx, "Notification not queued", "error", err)
+			return
+		}
+
+		writer.WriteHeader(202)
+		return
+	}
+
+	if s.pushSlots != nil {
+		select {
+		case s.pushSlots <- struct{}{}:
+			defer func() { <-s.pushSlots }()
+		default:
+			writer.Header().Set("Retry-After", "1")
+			writer.WriteHeader(503)
+			fmt.Fprintln(writer, "Too many notifications being sent")
+			requestLog.WarnContext(ctx, "Too many concurrent pushes")
+			return
+		}
+	}
+
+	res, err := s.send(ctx, start, client, notification, requestLog)
+	if res != nil {
+		setSpanAttribute(ctx, "apns_id", res.ApnsID)
+	}
+	if err == errNotificationExpired {
+		// The notification would have been discarded by APNs anyway.
+		writer.WriteHeader(201)
+	} else if err == errCircuitOpen {
+		writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(s.breaker.timeout.Seconds()))))
+		writer.WriteHeader(503)
+		fmt.Fprintln(writer, err)
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		writer.WriteHeader(504)
+		fmt.Fprintln(writer, "Timed out waiting for APNs")
+	} else if err != nil {
+		writer.WriteHeader(500)
+		fmt.Fprintln(writer, "Push error:", err)
+	} else if res.Sent() {
+		writer.Header().Add("Location", messageLocation(res.ApnsID))
+		writer.Header().Set("Content-Type", "application/json")
 		writer.WriteHeader(201)
-		log.Printf("Sent notification to %s -> %v %v %v", notification.DeviceToken, res.StatusCode, res.ApnsID, res.Reason)
-		log.Println("Expiration:", notification.Expiration)
-		log.Println("Priority:", notification.Priority)
-		log.Println("CollapseID:", notification.CollapseID)
+		json.NewEncoder(writer).Encode(map[string]interface{}{"apns_id": res.ApnsID})
 	} else {
+		// APNs answers 410 for device tokens that are no longer valid, which
+		// FCM calls UNREGISTERED, and the sender should stop using them.
+		if res.StatusCode == 410 || res.Reason == "UNREGISTERED" {
+			writer.Header().Set("X-Token-Status", "unregistered")
+		}
+		writer.Header().Set("Content-Type", "application/json")
 		writer.WriteHeader(res.StatusCode)
-		fmt.Fprintln(writer, res.Reason)
-		log.Printf("Failed to send: %v %v %v\n", res.StatusCode, res.ApnsID, res.Reason)
+		json.NewEncoder(writer).Encode(map[string]interface{}{
+			"error": res.Reason, "apns_id": res.ApnsID, "status": res.StatusCode,
+		})
+	}
+}
+
+// messageLocation returns a URI for a sent notification, for the Location
+// header. It identifies the notification, but can not be fetched.
+func messageLocation(id string) string {
+	if fcmPusher != nil {
+		// FCM message IDs are resource names such as projects/x/messages/y.
+		return "https://fcm.googleapis.com/v1/" + id
+	}
+
+	return "urn:uuid:" + id
+}
+
+// send pushes a notification, and records the outcome in the log and metrics.
+func (s *relayServer) send(ctx context.Context, start time.Time, client pusher, notification *apns2.Notification, log *slog.Logger) (*apns2.Response, error) {
+	if allowed, wait := s.breaker.allow(ctx); !allowed {
+		s.metrics.pushTotal.inc("circuit_open")
+		log.WarnContext(ctx, "Circuit breaker open, not sending notification", "retry_after_ms", wait.Milliseconds())
+		return nil, errCircuitOpen
+	}
+
+	res, err := s.pushWithRetry(ctx, client, notification, log)
+	s.breaker.record(ctx, isOutage(ctx, res, err))
+	duration := time.Since(start)
+	log = log.With("latency_ms", duration.Milliseconds())
+
+	if duration > slowPushThreshold {
+		apnsID := ""
+		if res != nil {
+			apnsID = res.ApnsID
+		}
+		log.WarnContext(ctx, "Slow push", "apns_id", apnsID, "duration_ms", duration.Milliseconds(), "success", err == nil && res.Sent())
+	}
+
+	if err == errNotificationExpired {
+		s.metrics.pushTotal.inc("expired")
+		log.WarnContext(ctx, "Notification expired before it could be sent")
+		return res, err
+	} else if err != nil {
+		s.metrics.pushTotal.inc("error")
+		log.ErrorContext(ctx, "Push error", "error", err)
+		return res, err
+	}
+
+	log = log.With("status_code", res.StatusCode, "apns_id", res.ApnsID, "reason", res.Reason)
+	if fcmPusher == nil {
+		recordAuthResult(ctx, res.Reason)
+	}
+
+	if res.Sent() {
+		s.metrics.pushTotal.inc("sent")
+		if s.sent != nil {
+			s.sent.remember(notification, res.ApnsID)
+		}
+		log.InfoContext(ctx, "Sent notification")
+	} else {
+		s.metrics.pushTotal.inc("failed")
+		s.metrics.apnsReasonTotal.inc(res.Reason)
+		log.WarnContext(ctx, "Failed to send")
+		reportInvalidToken(ctx, notification.DeviceToken, res.Reason)
+	}
+
+	return res, nil
+}
+
+// restrictTLS only allows TLS 1.2 and later, with forward secret AEAD cipher
+// suites. TLS 1.3 cipher suites are not configurable, and are all fine.
+func restrictTLS(config *tls.Config) *tls.Config {
+	config.MinVersion = tls.VersionTLS12
+	config.CipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+	}
+	return config
+}
+
+func environmentName(isProduction bool) string {
+	if isProduction {
+		return "production"
+	}
+	return "development"
+}
+
+// normalizeDeviceToken validates a device token from a URL. APNs device tokens
+// are hex, and accepted in either case, while FCM registration tokens are case
+// sensitive.
+func normalizeDeviceToken(token string) (string, error) {
+	if fcmPusher == nil {
+		token = strings.ToLower(token)
 	}
+
+	return token, validateDeviceToken(token)
+}
+
+func validateDeviceToken(token string) error {
+	pattern := deviceTokenPattern
+	if fcmPusher != nil {
+		pattern = fcmTokenPattern
+	}
+
+	if !pattern.MatchString(token) {
+		return errors.New(fmt.Sprintf("Device token must match %s", pattern))
+	}
+
+	return nil
 }
 
 func env(name, defaultValue string) string {
@@ -192,6 +1126,71 @@ func env(name, defaultValue string) string {
 	}
 }
 
+// requireEnv returns the value of a mandatory environment variable, and exits
+// if it is unset or empty.
+func requireEnv(name string) string {
+	value := env(name, "")
+	if value == "" {
+		log.Fatalf("%s must be set\n", name)
+	}
+
+	return value
+}
+
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	value := env(name, "")
+	if value == "" {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		log.Fatalf("Invalid %s: %s\n", name, value)
+	}
+
+	return duration
+}
+
+func envFloat(name string, defaultValue float64) float64 {
+	value := env(name, "")
+	if value == "" {
+		return defaultValue
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		log.Fatalf("Invalid %s: %s\n", name, value)
+	}
+
+	return number
+}
+
+func envInt(name string, defaultValue int) int {
+	value := env(name, "")
+	if value == "" {
+		return defaultValue
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		log.Fatalf("Invalid %s: %s\n", name, value)
+	}
+
+	return number
+}
+
+// checkEncryptionHeaders rejects Crypto-Key and Encryption headers longer than
+// maxEncryptionHeaderBytes, before anything is decoded from them.
+func checkEncryptionHeaders(header http.Header) error {
+	for _, name := range []string{"Crypto-Key", "Encryption"} {
+		if length := len(header.Get(name)); length > maxEncryptionHeaderBytes {
+			return errors.New(fmt.Sprintf("%s header of %d bytes is longer than %d bytes", name, length, maxEncryptionHeaderBytes))
+		}
+	}
+
+	return nil
+}
+
 func encodedValue(header http.Header, name, key string) (string, error) {
 	keyValues := parseKeyValues(header.Get(name))
 	value, exists := keyValues[key]
@@ -199,70 +1198,66 @@ func encodedValue(header http.Header, name, key string) (string, error) {
 		return "", errors.New(fmt.Sprintf("Value %s not found in header %s", key, name))
 	}
 
-	bytes, err := base64.RawURLEncoding.DecodeString(value)
+	// Values should be unpadded, but some senders pad them anyway.
+	bytes, err := decodeBase64URL(value)
 	if err != nil {
 		return "", err
 	}
-
-	return encode85(bytes), nil
-}
-
-func parseKeyValues(values string) map[string]string {
-	f := func(c rune) bool {
-		return c == ';'
-	}
-
-	entries := strings.FieldsFunc(values, f)
-
-	m := make(map[string]string)
-	for _, entry := range entries {
-		parts := strings.Split(entry, "=")
-		m[parts[0]] = parts[1]
+	if len(bytes) == 0 {
+		return "", errors.New(fmt.Sprintf("Value %s is empty in header %s", key, name))
 	}
 
-	return m
+	return z85.Encode(bytes), nil
 }
 
-var z85digits = []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ.-:+=^!/*?&<>()[]{}@%$#")
+// parseAES128GCMHeader splits an aes128gcm message (RFC 8188) into the salt,
+// the sender public key stored in the keyid field, and the remaining ciphertext.
+// Web Push (RFC 8291) requires the keyid to be a 65 byte uncompressed P-256 key.
+func parseAES128GCMHeader(body []byte) ([]byte, []byte, []byte, error) {
+	const saltLength = 16
+	const publicKeyLength = 65
+	const headerLength = saltLength + 4 + 1
 
-func encode85(bytes []byte) string {
-	numBlocks := len(bytes) / 4
-	suffixLength := len(bytes) % 4
+	if len(body) < headerLength {
+		return nil, nil, nil, errors.New(fmt.Sprintf("Body too short for header: %d bytes", len(body)))
+	}
 
-	encodedLength := numBlocks * 5
-	if suffixLength != 0 {
-		encodedLength += suffixLength + 1
+	salt := body[:saltLength]
+	idLength := int(body[saltLength+4])
+	if idLength != publicKeyLength {
+		return nil, nil, nil, errors.New(fmt.Sprintf("Invalid key ID length: %d", idLength))
 	}
 
-	encodedBytes := make([]byte, encodedLength)
+	if len(body) < headerLength+idLength {
+		return nil, nil, nil, errors.New(fmt.Sprintf("Body too short for key ID: %d bytes", len(body)))
+	}
 
-	src := bytes
-	dest := encodedBytes
-	for block := 0; block < numBlocks; block++ {
-		value := binary.BigEndian.Uint32(src)
+	publicKey := body[headerLength : headerLength+idLength]
+	ciphertext := body[headerLength+idLength:]
 
-		for i := 0; i < 5; i++ {
-			dest[4-i] = z85digits[value%85]
-			value /= 85
-		}
+	return salt, publicKey, ciphertext, nil
+}
 
-		src = src[4:]
-		dest = dest[5:]
+func parseKeyValues(values string) map[string]string {
+	f := func(c rune) bool {
+		return c == ';'
 	}
 
-	if suffixLength != 0 {
-		value := 0
+	entries := strings.FieldsFunc(values, f)
 
-		for i := 0; i < suffixLength; i++ {
-			value *= 256
-			value |= int(src[i])
+	m := make(map[string]string)
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			continue
 		}
-
-		for i := 0; i < suffixLength+1; i++ {
-			dest[suffixLength-i] = z85digits[value%85]
-			value /= 85
+		// Values may also be sent as quoted strings (RFC 7230).
+		value := strings.TrimSpace(parts[1])
+		if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+			value = value[1 : len(value)-1]
 		}
+		m[strings.TrimSpace(parts[0])] = value
 	}
 
-	return string(encodedBytes)
+	return m
 }
@@ -0,0 +1,970 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DagAgren/toot-relay/pkg/z85"
+	"github.com/sideshow/apns2"
+)
+
+const testDeviceToken = "3f2a9c4e8b1d7a6f5e0c9b8a7d6e5f4a3b2c1d0e9f8a7b6c5d4e3f2a1b0c9d8e"
+
+func TestMain(m *testing.M) {
+	logger = slog.New(contextHandler{slog.NewJSONHandler(io.Discard, nil)})
+	topic = "cx.c3.toot"
+	retryBaseDelay = 0
+
+	os.Exit(m.Run())
+}
+
+// fakePusher records the notifications pushed with it, and answers them with
+// respond, or as sent if that is nil.
+type fakePusher struct {
+	respond func(notification *apns2.Notification) (*apns2.Response, error)
+
+	mutex         sync.Mutex
+	notifications []*apns2.Notification
+}
+
+func (p *fakePusher) Push(notification *apns2.Notification) (*apns2.Response, error) {
+	return p.PushWithContext(nil, notification)
+}
+
+func (p *fakePusher) PushWithContext(ctx apns2.Context, notification *apns2.Notification) (*apns2.Response, error) {
+	p.mutex.Lock()
+	p.notifications = append(p.notifications, notification)
+	p.mutex.Unlock()
+
+	if p.respond != nil {
+		return p.respond(notification)
+	}
+	return &apns2.Response{StatusCode: 200, ApnsID: "8f7e2c1a-4b3d-4e5f-9a8b-7c6d5e4f3a2b"}, nil
+}
+
+func (p *fakePusher) pushed() []*apns2.Notification {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]*apns2.Notification(nil), p.notifications...)
+}
+
+// newTestRelay returns a relay that sends every notification with p. Like
+// newRelayServer, it has none of the limits that span requests, which tests
+// that need them set up on it.
+func newTestRelay(p pusher) *relayServer {
+	return newRelayServer(clientPair{development: p, production: p})
+}
+
+// relayRequest returns a POST to the production relay URL for deviceToken, with
+// the path values set as the mux would.
+func relayRequest(deviceToken string, body []byte, header map[string]string) *http.Request {
+	request := httptest.NewRequest("POST", "/relay-to/production/"+deviceToken, bytes.NewReader(body))
+	request.SetPathValue("environment", "production")
+	request.SetPathValue("token", deviceToken)
+	for name, value := range header {
+		request.Header.Set(name, value)
+	}
+	return request
+}
+
+// aesgcmHeaders returns the headers of an aesgcm message, with a fixed public
+// key and salt.
+func aesgcmHeaders() map[string]string {
+	return map[string]string{
+		"Content-Encoding": "aesgcm",
+		"Crypto-Key":       "dh=" + base64.RawURLEncoding.EncodeToString(bytes.Repeat([]byte{4}, 65)),
+		"Encryption":       "salt=" + base64.RawURLEncoding.EncodeToString(bytes.Repeat([]byte{7}, 16)),
+	}
+}
+
+// post sends request to the handler of relay, and returns the response.
+func post(relay *relayServer, request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	relay.handler(recorder, request)
+	return recorder
+}
+
+// payloadFields returns the payload of a notification as decoded JSON.
+func payloadFields(t *testing.T, notification *apns2.Notification) map[string]interface{} {
+	t.Helper()
+	encoded, err := json.Marshal(notification.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+// aes128gcmBody returns an aes128gcm message with a record size of 4096.
+func aes128gcmBody(salt, publicKey, ciphertext []byte) []byte {
+	body := append([]byte(nil), salt...)
+	body = append(body, 0, 0, 16, 0, byte(len(publicKey)))
+	body = append(body, publicKey...)
+	return append(body, ciphertext...)
+}
+
+func TestHandlerBodyLimit(t *testing.T) {
+	tests := []struct {
+		length   int
+		tooLarge bool
+	}{
+		{maxBodyBytes - 1, false},
+		{maxBodyBytes, false},
+		{maxBodyBytes + 1, true},
+		{10 * maxBodyBytes, true},
+	}
+
+	for _, test := range tests {
+		// Without encryption headers, bodies within the limit are read and
+		// then rejected before anything is sent.
+		request := httptest.NewRequest("POST", "/relay-to/development/"+strings.Repeat("0", 64), bytes.NewReader(make([]byte, test.length)))
+		request.SetPathValue("environment", "development")
+		request.SetPathValue("token", strings.Repeat("0", 64))
+		recorder := httptest.NewRecorder()
+		newRelayServer(clientPair{}).handler(recorder, request)
+
+		if tooLarge := recorder.Code == 413; tooLarge != test.tooLarge {
+			t.Errorf("%d bytes: got status %d", test.length, recorder.Code)
+		}
+	}
+}
+
+func TestHandlerPushType(t *testing.T) {
+	var pushType, priority string
+	apns := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		pushType, priority = request.Header.Get("apns-push-type"), request.Header.Get("apns-priority")
+		writer.Header().Set("apns-id", "00000000-0000-0000-0000-000000000000")
+	}))
+	defer apns.Close()
+
+	client := &apns2.Client{
+		HTTPClient: &http.Client{Transport: apnsTransport{http.DefaultTransport}},
+		Host:       apns.URL,
+	}
+	relay := newRelayServer(clientPair{development: client, production: client})
+
+	tests := []struct {
+		name     string
+		header   map[string]string
+		silent   bool
+		pushType string
+		priority string
+	}{
+		{"default alert", nil, false, pushTypeAlert, "10"},
+		{"empty alert", map[string]string{"Alert": `""`}, false, pushTypeBackground, "5"},
+		{"silent", nil, true, pushTypeBackground, "5"},
+		{"silent with high urgency", map[string]string{"Urgency": "high"}, true, pushTypeBackground, "5"},
+		{"empty alert with badge", map[string]string{"Alert": `""`, "Badge": "1"}, false, pushTypeAlert, "10"},
+		{"empty alert with sound", map[string]string{"Alert": `""`, "Sound": "default"}, false, pushTypeAlert, "10"},
+	}
+
+	defer func(silent bool) { silentPush = silent }(silentPush)
+	for i, test := range tests {
+		silentPush = test.silent
+
+		// Each case goes to its own device token, so none are rate limited
+		// or deduplicated.
+		deviceToken := fmt.Sprintf("%064x", i)
+		request := httptest.NewRequest("POST", "/relay-to/development/"+deviceToken, strings.NewReader("message"))
+		request.SetPathValue("environment", "development")
+		request.SetPathValue("token", deviceToken)
+		request.Header.Set("Content-Encoding", "aesgcm")
+		request.Header.Set("Crypto-Key", "dh=BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcx")
+		request.Header.Set("Encryption", "salt=lngarbyKfMoi9Z75xYXmkg")
+		for name, value := range test.header {
+			request.Header.Set(name, value)
+		}
+		recorder := httptest.NewRecorder()
+		relay.handler(recorder, request)
+
+		if recorder.Code != 201 {
+			t.Fatalf("%s: got status %d, want 201: %s", test.name, recorder.Code, recorder.Body)
+		}
+		if pushType != test.pushType || priority != test.priority {
+			t.Errorf("%s: got push type %s with priority %s, want %s with %s", test.name, pushType, priority, test.pushType, test.priority)
+		}
+	}
+}
+
+func TestHandlerInvalidTTL(t *testing.T) {
+	// Invalid TTLs are ignored, leaving the notification without an
+	// expiration.
+	for _, ttl := range []string{"soon", "1.5", "60s", "0x10", " "} {
+		header := aesgcmHeaders()
+		header["TTL"] = ttl
+
+		pusher := &fakePusher{}
+		if response := post(newTestRelay(pusher), relayRequest(testDeviceToken, []byte("message"), header)); response.Code != 201 {
+			t.Fatalf("TTL %q: got status %d, want 201", ttl, response.Code)
+		}
+		if expiration := pusher.pushed()[0].Expiration; !expiration.IsZero() {
+			t.Errorf("TTL %q: got expiration %v, want none", ttl, expiration)
+		}
+	}
+}
+
+func TestHandlerDefaultTTL(t *testing.T) {
+	tests := []struct {
+		defaultTTL string
+		ttl        string
+		expires    time.Duration
+		never      bool
+	}{
+		{"", "", 0, true},
+		{"3600", "", time.Hour, false},
+		{"3600", "60", time.Minute, false},
+		{"0", "", 0, false},
+	}
+
+	defer func(ttl string) { defaultTTL = ttl }(defaultTTL)
+	for _, test := range tests {
+		defaultTTL = test.defaultTTL
+		header := aesgcmHeaders()
+		if test.ttl != "" {
+			header["TTL"] = test.ttl
+		}
+
+		pusher := &fakePusher{}
+		before := time.Now()
+		if response := post(newTestRelay(pusher), relayRequest(testDeviceToken, []byte("message"), header)); response.Code != 201 {
+			t.Fatalf("DEFAULT_TTL %q with TTL %q: got status %d, want 201", test.defaultTTL, test.ttl, response.Code)
+		}
+
+		expiration := pusher.pushed()[0].Expiration
+		if test.never {
+			if !expiration.IsZero() {
+				t.Errorf("DEFAULT_TTL %q with TTL %q: got expiration %v, want none", test.defaultTTL, test.ttl, expiration)
+			}
+		} else if expiration.Before(before.Add(test.expires)) || expiration.After(time.Now().Add(test.expires)) {
+			t.Errorf("DEFAULT_TTL %q with TTL %q: got expiration in %v, want %v", test.defaultTTL, test.ttl, expiration.Sub(before), test.expires)
+		}
+	}
+}
+
+func TestRestrictTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = restrictTLS(&tls.Config{})
+	// Refused handshakes are expected, and would be logged.
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		config *tls.Config
+		ok     bool
+	}{
+		{"TLS 1.3", &tls.Config{MinVersion: tls.VersionTLS13}, true},
+		{"TLS 1.2 with AES-GCM", &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}}, true},
+		{"TLS 1.2 with AES-CBC", &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA}}, false},
+		{"TLS 1.1", &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}, false},
+	}
+
+	for _, test := range tests {
+		config := test.config
+		config.RootCAs = server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+
+		response, err := client.Get(server.URL)
+		if err == nil {
+			response.Body.Close()
+		}
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want success %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func BenchmarkHandler(b *testing.B) {
+	// Unlike fakePusher, this does not keep every notification.
+	relay := newTestRelay(pusherFunc(func(apns2.Context, *apns2.Notification) (*apns2.Response, error) {
+		return &apns2.Response{StatusCode: 200}, nil
+	}))
+	body := make([]byte, 2048)
+	header := aesgcmHeaders()
+
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if response := post(relay, relayRequest(testDeviceToken, body, header)); response.Code != 201 {
+			b.Fatalf("got status %d, want 201", response.Code)
+		}
+	}
+}
+
+func TestHandlerTokenStatus(t *testing.T) {
+	tests := []struct {
+		status      int
+		reason      string
+		tokenStatus string
+	}{
+		{410, apns2.ReasonUnregistered, "unregistered"},
+		{404, "UNREGISTERED", "unregistered"},
+		{400, apns2.ReasonBadDeviceToken, ""},
+		{429, apns2.ReasonTooManyRequests, ""},
+	}
+
+	for _, test := range tests {
+		pusher := &fakePusher{respond: func(*apns2.Notification) (*apns2.Response, error) {
+			return &apns2.Response{StatusCode: test.status, Reason: test.reason}, nil
+		}}
+
+		response := post(newTestRelay(pusher), relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders()))
+		if response.Code != test.status || response.Header().Get("X-Token-Status") != test.tokenStatus {
+			t.Errorf("%d %s: got status %d with X-Token-Status %q, want %d with %q", test.status, test.reason, response.Code, response.Header().Get("X-Token-Status"), test.status, test.tokenStatus)
+		}
+	}
+}
+
+func TestHandlerSpacedHeaders(t *testing.T) {
+	publicKey := base64.RawURLEncoding.EncodeToString(bytes.Repeat([]byte{4}, 65))
+	salt := base64.RawURLEncoding.EncodeToString(bytes.Repeat([]byte{7}, 16))
+
+	for _, header := range []map[string]string{
+		{"Crypto-Key": "dh=" + publicKey + "; p256ecdsa=BDd3_hVL9fZi9Ybo2UUzA284WG5FZR30", "Encryption": " salt = " + salt},
+		{"Crypto-Key": `p256ecdsa="BDd3_hVL9fZi9Ybo2UUzA284WG5FZR30" ; dh="` + publicKey + `"`, "Encryption": `keyid=p256dh;salt="` + salt + `";rs=4096`},
+	} {
+		header["Content-Encoding"] = "aesgcm"
+		pusher := &fakePusher{}
+		if response := post(newTestRelay(pusher), relayRequest(testDeviceToken, []byte("message"), header)); response.Code != 201 {
+			t.Fatalf("%v: got status %d, want 201: %s", header, response.Code, response.Body)
+		}
+
+		fields := payloadFields(t, pusher.pushed()[0])
+		if fields["k"] != z85.Encode(bytes.Repeat([]byte{4}, 65)) || fields["s"] != z85.Encode(bytes.Repeat([]byte{7}, 16)) {
+			t.Errorf("%v: got k %v and s %v", header, fields["k"], fields["s"])
+		}
+	}
+}
+
+func TestHandlerUrgency(t *testing.T) {
+	tests := []struct {
+		urgency        string
+		normalPriority int
+		priority       int
+	}{
+		{"very-low", apns2.PriorityHigh, apns2.PriorityLow},
+		{"low", apns2.PriorityHigh, apns2.PriorityLow},
+		{"normal", apns2.PriorityHigh, apns2.PriorityHigh},
+		{"normal", apns2.PriorityLow, apns2.PriorityLow},
+		{"", apns2.PriorityLow, apns2.PriorityLow},
+		{"high", apns2.PriorityLow, apns2.PriorityHigh},
+		{"urgent", apns2.PriorityLow, apns2.PriorityLow},
+	}
+
+	defer func(priority int) { normalPriority = priority }(normalPriority)
+	for _, test := range tests {
+		normalPriority = test.normalPriority
+		header := aesgcmHeaders()
+		if test.urgency != "" {
+			header["Urgency"] = test.urgency
+		}
+
+		pusher := &fakePusher{}
+		if response := post(newTestRelay(pusher), relayRequest(testDeviceToken, []byte("message"), header)); response.Code != 201 {
+			t.Fatalf("Urgency %q: got status %d, want 201", test.urgency, response.Code)
+		}
+		if priority := pusher.pushed()[0].Priority; priority != test.priority {
+			t.Errorf("Urgency %q with normal priority %d: got priority %d, want %d", test.urgency, test.normalPriority, priority, test.priority)
+		}
+	}
+}
+
+func TestHandlerOversizedEncryptionHeaders(t *testing.T) {
+	for _, name := range []string{"Crypto-Key", "Encryption"} {
+		header := aesgcmHeaders()
+		header[name] += ";padding=" + strings.Repeat("A", maxEncryptionHeaderBytes)
+
+		pusher := &fakePusher{}
+		response := post(newTestRelay(pusher), relayRequest(testDeviceToken, []byte("message"), header))
+		if response.Code != 400 || !strings.Contains(response.Body.String(), name) {
+			t.Errorf("%s: got status %d, want 400: %s", name, response.Code, response.Body)
+		}
+		if len(pusher.pushed()) != 0 {
+			t.Errorf("%s: pushed a notification with an oversized header", name)
+		}
+	}
+
+	// Headers at the limit are still accepted.
+	header := aesgcmHeaders()
+	header["Crypto-Key"] += ";p=" + strings.Repeat("A", maxEncryptionHeaderBytes-len(header["Crypto-Key"])-3)
+	if response := post(newTestRelay(&fakePusher{}), relayRequest(testDeviceToken, []byte("message"), header)); response.Code != 201 {
+		t.Errorf("got status %d for a header at the limit, want 201", response.Code)
+	}
+}
+
+func TestParseKeyValues(t *testing.T) {
+	tests := []struct {
+		values string
+		want   map[string]string
+	}{
+		{"", map[string]string{}},
+		{"dh=abc", map[string]string{"dh": "abc"}},
+		{"dh=abc;p256ecdsa=def", map[string]string{"dh": "abc", "p256ecdsa": "def"}},
+		{"salt=abc==", map[string]string{"salt": "abc=="}},
+		{"keyid=a=b=c", map[string]string{"keyid": "a=b=c"}},
+		{`dh="abc"`, map[string]string{"dh": "abc"}},
+		{`dh="abc;`, map[string]string{"dh": `"abc`}},
+		{`dh=""`, map[string]string{"dh": ""}},
+		{`dh="`, map[string]string{"dh": `"`}},
+		{" dh = abc ; salt = def ", map[string]string{"dh": "abc", "salt": "def"}},
+		{";;dh=abc;;", map[string]string{"dh": "abc"}},
+		{"dh;salt=def", map[string]string{"salt": "def"}},
+		{"dh=;salt=def", map[string]string{"dh": "", "salt": "def"}},
+		{"dh=abc;dh=def", map[string]string{"dh": "def"}},
+		{";", map[string]string{}},
+	}
+
+	for _, test := range tests {
+		if got := parseKeyValues(test.values); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseKeyValues(%q) = %q, want %q", test.values, got, test.want)
+		}
+	}
+}
+
+func TestHandlerAES128GCM(t *testing.T) {
+	salt := bytes.Repeat([]byte{1}, 16)
+	publicKey := bytes.Repeat([]byte{4}, 65)
+	ciphertext := []byte("ciphertext of the message")
+
+	body := aes128gcmBody(salt, publicKey, ciphertext)
+
+	pusher := &fakePusher{}
+	response := post(newTestRelay(pusher), relayRequest(testDeviceToken, body, map[string]string{"Content-Encoding": "aes128gcm"}))
+	if response.Code != 201 {
+		t.Fatalf("got status %d, want 201: %s", response.Code, response.Body)
+	}
+
+	notifications := pusher.pushed()
+	if len(notifications) != 1 {
+		t.Fatalf("got %d notifications, want 1", len(notifications))
+	}
+
+	fields := payloadFields(t, notifications[0])
+	want := map[string]string{
+		"p":  z85.Encode(ciphertext),
+		"as": z85.Encode(salt),
+		"ak": z85.Encode(publicKey),
+		"e":  "aes128gcm",
+	}
+	for name, value := range want {
+		if fields[name] != value {
+			t.Errorf("got %s %v, want %v", name, fields[name], value)
+		}
+	}
+	for _, name := range []string{"k", "s"} {
+		if _, exists := fields[name]; exists {
+			t.Errorf("got aesgcm field %s in aes128gcm payload", name)
+		}
+	}
+}
+
+func TestHandlerAES128GCMTooShort(t *testing.T) {
+	pusher := &fakePusher{}
+	response := post(newTestRelay(pusher), relayRequest(testDeviceToken, []byte("short"), map[string]string{"Content-Encoding": "aes128gcm"}))
+	if response.Code != 400 {
+		t.Errorf("got status %d, want 400", response.Code)
+	}
+	if len(pusher.pushed()) != 0 {
+		t.Error("pushed a notification for an invalid message")
+	}
+}
+
+func TestHandlerTopicBundle(t *testing.T) {
+	tests := []struct {
+		bundle string
+		topic  string
+	}{
+		{"", "cx.c3.toot"},
+		{"org.example.other", "org.example.other"},
+	}
+
+	for _, test := range tests {
+		header := aesgcmHeaders()
+		if test.bundle != "" {
+			header["Topic-Bundle"] = test.bundle
+		}
+
+		pusher := &fakePusher{}
+		response := post(newTestRelay(pusher), relayRequest(testDeviceToken, []byte("message"), header))
+		if response.Code != 201 {
+			t.Fatalf("got status %d, want 201: %s", response.Code, response.Body)
+		}
+		if topic := pusher.pushed()[0].Topic; topic != test.topic {
+			t.Errorf("Topic-Bundle %q: got topic %q, want %q", test.bundle, topic, test.topic)
+		}
+	}
+}
+
+func TestNormalizeDeviceToken(t *testing.T) {
+	tests := []struct {
+		token      string
+		normalized string
+		valid      bool
+	}{
+		{testDeviceToken, testDeviceToken, true},
+		{strings.ToUpper(testDeviceToken), testDeviceToken, true},
+		{testDeviceToken[:63], "", false},
+		{"", "", false},
+		{testDeviceToken[:63] + "g", "", false},
+		{testDeviceToken + "00", "", false},
+	}
+
+	for _, test := range tests {
+		normalized, err := normalizeDeviceToken(test.token)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: got error %v, want valid %v", test.token, err, test.valid)
+		}
+		if test.valid && normalized != test.normalized {
+			t.Errorf("%q: got %q, want %q", test.token, normalized, test.normalized)
+		}
+	}
+}
+
+func TestHandlerInvalidDeviceToken(t *testing.T) {
+	pusher := &fakePusher{}
+	response := post(newTestRelay(pusher), relayRequest("not-hex", []byte("message"), aesgcmHeaders()))
+	if response.Code != 400 {
+		t.Errorf("got status %d, want 400", response.Code)
+	}
+	if len(pusher.pushed()) != 0 {
+		t.Error("pushed a notification to an invalid device token")
+	}
+}
+
+func TestHandlerAlert(t *testing.T) {
+	tests := []struct {
+		name   string
+		alert  *string
+		silent bool
+		want   interface{}
+	}{
+		{"default", nil, false, "🎺"},
+		{"override", stringPointer("New mention"), false, "New mention"},
+		{"empty", stringPointer(`""`), false, nil},
+		{"silent", nil, true, nil},
+		{"silent with override", stringPointer("New mention"), true, nil},
+	}
+
+	defer func(silent bool) { silentPush = silent }(silentPush)
+	for _, test := range tests {
+		silentPush = test.silent
+		header := aesgcmHeaders()
+		if test.alert != nil {
+			header["Alert"] = *test.alert
+		}
+
+		pusher := &fakePusher{}
+		if response := post(newTestRelay(pusher), relayRequest(testDeviceToken, []byte("message"), header)); response.Code != 201 {
+			t.Fatalf("%s: got status %d, want 201", test.name, response.Code)
+		}
+
+		aps := payloadFields(t, pusher.pushed()[0])["aps"].(map[string]interface{})
+		if aps["alert"] != test.want {
+			t.Errorf("%s: got alert %v, want %v", test.name, aps["alert"], test.want)
+		}
+		if aps["content-available"] != float64(1) || aps["mutable-content"] != float64(1) {
+			t.Errorf("%s: got aps %v, want content-available and mutable-content", test.name, aps)
+		}
+	}
+}
+
+func stringPointer(s string) *string {
+	return &s
+}
+
+func TestHandlerBodyTooLarge(t *testing.T) {
+	for _, contentEncoding := range []string{"aesgcm", "aes128gcm"} {
+		header := aesgcmHeaders()
+		header["Content-Encoding"] = contentEncoding
+
+		pusher := &fakePusher{}
+		response := post(newTestRelay(pusher), relayRequest(testDeviceToken, make([]byte, maxBodyBytes+1), header))
+		if response.Code != 413 {
+			t.Errorf("%s: got status %d, want 413", contentEncoding, response.Code)
+		}
+		if len(pusher.pushed()) != 0 {
+			t.Errorf("%s: pushed a notification for an oversized body", contentEncoding)
+		}
+	}
+}
+
+func TestHandlerBogusContentLength(t *testing.T) {
+	// A Content-Length far above the limit must not be used to size buffers.
+	for _, contentLength := range []int64{1 << 62, -1} {
+		request := relayRequest(testDeviceToken, make([]byte, maxBodyBytes+1), aesgcmHeaders())
+		request.ContentLength = contentLength
+
+		pusher := &fakePusher{}
+		if response := post(newTestRelay(pusher), request); response.Code != 413 {
+			t.Errorf("Content-Length %d: got status %d, want 413", contentLength, response.Code)
+		}
+		if len(pusher.pushed()) != 0 {
+			t.Errorf("Content-Length %d: pushed a notification for an oversized body", contentLength)
+		}
+	}
+}
+
+func TestHandlerPayloadTooLarge(t *testing.T) {
+	// Bodies at the limit are accepted, but are too large for APNs once
+	// encoded.
+	pusher := &fakePusher{}
+	response := post(newTestRelay(pusher), relayRequest(testDeviceToken, make([]byte, maxBodyBytes), aesgcmHeaders()))
+	if response.Code != 413 {
+		t.Errorf("got status %d, want 413", response.Code)
+	}
+	if len(pusher.pushed()) != 0 {
+		t.Error("pushed a notification too large for APNs")
+	}
+}
+
+func TestHandlerMalformedEncryptionHeaders(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"Crypto-Key", "dh"},
+		{"Crypto-Key", "dh="},
+		{"Crypto-Key", "dh=="},
+		{"Crypto-Key", ";;"},
+		{"Crypto-Key", "dh=!!!"},
+		{"Encryption", "salt"},
+		{"Encryption", ""},
+	}
+
+	for _, test := range tests {
+		header := aesgcmHeaders()
+		header[test.name] = test.value
+
+		pusher := &fakePusher{}
+		response := post(newTestRelay(pusher), relayRequest(testDeviceToken, []byte("message"), header))
+		if response.Code != 400 {
+			t.Errorf("%s: %q: got status %d, want 400", test.name, test.value, response.Code)
+		}
+		if len(pusher.pushed()) != 0 {
+			t.Errorf("%s: %q: pushed a notification", test.name, test.value)
+		}
+	}
+}
+
+func TestHandlerTTL(t *testing.T) {
+	tests := []struct {
+		ttl     string
+		expires time.Duration
+	}{
+		{"60", time.Minute},
+		{"0", 0},
+		{"-5", 0},
+		{"2419200", apnsMaxTTL * time.Second},
+		{"2419201", apnsMaxTTL * time.Second},
+		{"99999999999999999999", apnsMaxTTL * time.Second},
+		{"-99999999999999999999", 0},
+	}
+
+	for _, test := range tests {
+		header := aesgcmHeaders()
+		header["TTL"] = test.ttl
+
+		pusher := &fakePusher{}
+		before := time.Now()
+		if response := post(newTestRelay(pusher), relayRequest(testDeviceToken, []byte("message"), header)); response.Code != 201 {
+			t.Fatalf("TTL %q: got status %d, want 201", test.ttl, response.Code)
+		}
+
+		expiration := pusher.pushed()[0].Expiration
+		if expiration.Before(before.Add(test.expires)) || expiration.After(time.Now().Add(test.expires)) {
+			t.Errorf("TTL %q: got expiration in %v, want %v", test.ttl, expiration.Sub(before), test.expires)
+		}
+	}
+}
+
+// pushedAPS posts a message with header added to the aesgcm headers, and
+// returns the aps dictionary of the notification pushed.
+func pushedAPS(t *testing.T, header map[string]string) map[string]interface{} {
+	t.Helper()
+	request := aesgcmHeaders()
+	for name, value := range header {
+		request[name] = value
+	}
+
+	pusher := &fakePusher{}
+	if response := post(newTestRelay(pusher), relayRequest(testDeviceToken, []byte("message"), request)); response.Code != 201 {
+		t.Fatalf("got status %d, want 201: %s", response.Code, response.Body)
+	}
+	return payloadFields(t, pusher.pushed()[0])["aps"].(map[string]interface{})
+}
+
+func TestHandlerBadge(t *testing.T) {
+	tests := []struct {
+		badge string
+		want  interface{}
+	}{
+		{"", nil},
+		{"3", float64(3)},
+		{"0", float64(0)},
+		{"-1", nil},
+		{"many", nil},
+	}
+
+	for _, test := range tests {
+		header := map[string]string{}
+		if test.badge != "" {
+			header["Badge"] = test.badge
+		}
+
+		if badge := pushedAPS(t, header)["badge"]; badge != test.want {
+			t.Errorf("Badge %q: got %v, want %v", test.badge, badge, test.want)
+		}
+	}
+}
+
+func TestHandlerSound(t *testing.T) {
+	tests := []struct {
+		sound string
+		want  interface{}
+	}{
+		{"", nil},
+		{"chime.caf", "chime.caf"},
+		{"default", "default"},
+		{`{"name":"alarm.caf","volume":0.5}`, map[string]interface{}{"critical": float64(1), "name": "alarm.caf", "volume": 0.5}},
+		{`{"volume":0.25}`, map[string]interface{}{"critical": float64(1), "name": "default", "volume": 0.25}},
+		{`{not json`, nil},
+	}
+
+	for _, test := range tests {
+		header := map[string]string{}
+		if test.sound != "" {
+			header["Sound"] = test.sound
+		}
+
+		if sound := pushedAPS(t, header)["sound"]; !reflect.DeepEqual(sound, test.want) {
+			t.Errorf("Sound %q: got %v, want %v", test.sound, sound, test.want)
+		}
+	}
+}
+
+func TestHandlerThreadID(t *testing.T) {
+	if threadID := pushedAPS(t, nil)["thread-id"]; threadID != nil {
+		t.Errorf("got thread-id %v without a Thread-Id header", threadID)
+	}
+	if threadID := pushedAPS(t, map[string]string{"Thread-Id": " account-1 "})["thread-id"]; threadID != "account-1" {
+		t.Errorf("got thread-id %v, want account-1", threadID)
+	}
+
+	header := aesgcmHeaders()
+	header["Thread-Id"] = " "
+	pusher := &fakePusher{}
+	if response := post(newTestRelay(pusher), relayRequest(testDeviceToken, []byte("message"), header)); response.Code != 400 {
+		t.Errorf("empty Thread-Id: got status %d, want 400", response.Code)
+	}
+	if len(pusher.pushed()) != 0 {
+		t.Error("pushed a notification with an empty Thread-Id")
+	}
+}
+
+func TestNewServerTimeouts(t *testing.T) {
+	tests := []struct {
+		env               map[string]string
+		read, write, idle time.Duration
+	}{
+		{map[string]string{}, 30 * time.Second, 2 * time.Minute, 2 * time.Minute},
+		{map[string]string{"HTTP_READ_TIMEOUT": "5s", "HTTP_WRITE_TIMEOUT": "1m30s", "HTTP_IDLE_TIMEOUT": "500ms"}, 5 * time.Second, 90 * time.Second, 500 * time.Millisecond},
+		{map[string]string{"HTTP_WRITE_TIMEOUT": "0s"}, 30 * time.Second, 0, 2 * time.Minute},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.env), func(t *testing.T) {
+			for _, name := range []string{"HTTP_READ_TIMEOUT", "HTTP_WRITE_TIMEOUT", "HTTP_IDLE_TIMEOUT"} {
+				t.Setenv(name, test.env[name])
+			}
+
+			server := newServer(":0", http.NotFoundHandler())
+			if server.ReadTimeout != test.read || server.WriteTimeout != test.write || server.IdleTimeout != test.idle {
+				t.Errorf("got timeouts %v, %v, %v, want %v, %v, %v", server.ReadTimeout, server.WriteTimeout, server.IdleTimeout, test.read, test.write, test.idle)
+			}
+		})
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		bindAddress, port, want string
+	}{
+		{"", "42069", ":42069"},
+		{"127.0.0.1", "42069", "127.0.0.1:42069"},
+		{"::1", "8080", "[::1]:8080"},
+		{"[::1]", "8080", "[::1]:8080"},
+		{"fe80::1%eth0", "8080", "[fe80::1%eth0]:8080"},
+	}
+
+	for _, test := range tests {
+		if got := listenAddress(test.bindAddress, test.port); got != test.want {
+			t.Errorf("listenAddress(%q, %q) = %q, want %q", test.bindAddress, test.port, got, test.want)
+		}
+	}
+}
+
+func TestParseKeyValuesPadding(t *testing.T) {
+	// Values are split at the first = only, so padding is kept.
+	values := parseKeyValues("dh=BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcx==;p256ecdsa=BDd3_hVL9fZi9Ybo2UUzA284WG5FZR30_95YeZJsiApwXKpNcF1rRPF3foIiBHXRdJI2Qhumhf6_LFTeZaNndIo=")
+
+	want := map[string]string{
+		"dh":        "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcx==",
+		"p256ecdsa": "BDd3_hVL9fZi9Ybo2UUzA284WG5FZR30_95YeZJsiApwXKpNcF1rRPF3foIiBHXRdJI2Qhumhf6_LFTeZaNndIo=",
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("got %v, want %v", values, want)
+	}
+
+	header := http.Header{"Crypto-Key": {"dh=" + base64.URLEncoding.EncodeToString([]byte{1, 2, 3, 4, 5})}}
+	encoded, err := encodedValue(header, "Crypto-Key", "dh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded != z85.Encode([]byte{1, 2, 3, 4, 5}) {
+		t.Errorf("got %q, want %q", encoded, z85.Encode([]byte{1, 2, 3, 4, 5}))
+	}
+}
+
+func TestHandlerResponseBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		res      *apns2.Response
+		status   int
+		body     map[string]interface{}
+		location string
+	}{
+		{
+			"sent",
+			&apns2.Response{StatusCode: 200, ApnsID: "apns-1"},
+			201,
+			map[string]interface{}{"apns_id": "apns-1"},
+			"urn:uuid:apns-1",
+		},
+		{
+			"bad device token",
+			&apns2.Response{StatusCode: 400, ApnsID: "apns-2", Reason: apns2.ReasonBadDeviceToken},
+			400,
+			map[string]interface{}{"error": "BadDeviceToken", "apns_id": "apns-2", "status": float64(400)},
+			"",
+		},
+	}
+
+	for _, test := range tests {
+		pusher := &fakePusher{respond: func(notification *apns2.Notification) (*apns2.Response, error) {
+			return test.res, nil
+		}}
+		response := post(newTestRelay(pusher), relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders()))
+		if response.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, response.Code, test.status)
+		}
+		if contentType := response.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("%s: got Content-Type %q", test.name, contentType)
+		}
+		if location := response.Header().Get("Location"); location != test.location {
+			t.Errorf("%s: got Location %q, want %q", test.name, location, test.location)
+		}
+
+		var body map[string]interface{}
+		if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(body, test.body) {
+			t.Errorf("%s: got %v, want %v", test.name, body, test.body)
+		}
+	}
+}
+
+func TestHandlerCollapseID(t *testing.T) {
+	tests := []struct {
+		topic      string
+		status     int
+		collapseID string
+	}{
+		{"", 201, ""},
+		{"new-mentions", 201, "new-mentions"},
+		{strings.Repeat("a", 64), 201, strings.Repeat("a", 64)},
+		// Longer topics are truncated to what APNs accepts, rather than
+		// rejected.
+		{strings.Repeat("a", 64) + "b", 201, strings.Repeat("a", 64)},
+		{"not a topic", 400, ""},
+		{"topic/with/slashes", 400, ""},
+	}
+
+	for _, test := range tests {
+		header := aesgcmHeaders()
+		if test.topic != "" {
+			header["Topic"] = test.topic
+		}
+
+		pusher := &fakePusher{}
+		response := post(newTestRelay(pusher), relayRequest(testDeviceToken, []byte("message"), header))
+		if response.Code != test.status {
+			t.Errorf("Topic %q: got status %d, want %d", test.topic, response.Code, test.status)
+			continue
+		}
+		if test.status == 201 && pusher.pushed()[0].CollapseID != test.collapseID {
+			t.Errorf("Topic %q: got collapse ID %q, want %q", test.topic, pusher.pushed()[0].CollapseID, test.collapseID)
+		}
+	}
+}
+
+func TestHandlerDryRun(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		dryRun bool
+		header string
+		status int
+	}{
+		{"DRY_RUN", true, "", 201},
+		{"X-Dry-Run", false, "true", 202},
+		{"both", true, "true", 201},
+	} {
+		header := aesgcmHeaders()
+		header["TTL"] = "60"
+		if test.header != "" {
+			header["X-Dry-Run"] = test.header
+		}
+
+		pusher := &fakePusher{}
+		relay := newTestRelay(pusher)
+		relay.dryRun = test.dryRun
+		response := post(relay, relayRequest(testDeviceToken, []byte("message"), header))
+		if response.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, response.Code, test.status)
+		}
+		if len(pusher.pushed()) != 0 {
+			t.Errorf("%s: pushed a notification in a dry run", test.name)
+		}
+
+		var body struct {
+			DeviceToken string                 `json:"device_token"`
+			Topic       string                 `json:"topic"`
+			Payload     map[string]interface{} `json:"payload"`
+		}
+		if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if body.DeviceToken != testDeviceToken || body.Topic != "cx.c3.toot" || body.Payload["p"] != z85.Encode([]byte("message")) {
+			t.Errorf("%s: got %+v", test.name, body)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal implementation of W3C Trace Context, enough to tie the requests
+// of a sender to the logs of the relay, and of OTLP/HTTP span export, so that
+// each request shows up as a span of the sender's trace.
+
+// traceparentPattern matches the traceparent header: the version, trace ID,
+// parent span ID and flags. Later versions may append more fields.
+var traceparentPattern = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})(-.*)?$`)
+
+// The OTLP span kinds used: a request to the relay, and a part of one.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+type span struct {
+	name         string
+	traceID      string
+	spanID       string
+	parentSpanID string
+	sampled      bool
+	kind         int
+	start        time.Time
+	end          time.Time
+	status       int
+
+	mutex      sync.Mutex
+	attributes map[string]string
+}
+
+// parseTraceparent returns the trace ID, parent span ID and whether the trace
+// is sampled, or ok false if the header is missing or invalid.
+func parseTraceparent(header string) (traceID, parentSpanID string, sampled, ok bool) {
+	match := traceparentPattern.FindStringSubmatch(header)
+	if match == nil || match[1] == "ff" || (match[1] == "00" && match[5] != "") {
+		return "", "", false, false
+	}
+	if strings.Trim(match[2], "0") == "" || strings.Trim(match[3], "0") == "" {
+		return "", "", false, false
+	}
+
+	flags, _ := strconv.ParseUint(match[4], 16, 8)
+	return match[2], match[3], flags&1 != 0, true
+}
+
+// startSpan starts a span named name, as a child of the span in ctx if there
+// is one, or of the span given by traceparent otherwise, or else as the root
+// of a new trace, which is sampled. It returns a context holding the new span.
+func startSpan(ctx context.Context, name, traceparent string) (context.Context, *span) {
+	s := &span{name: name, spanID: randomHex(8), sampled: true, kind: spanKindServer, start: time.Now(), attributes: make(map[string]string)}
+
+	if parent, ok := ctx.Value(spanKey).(*span); ok {
+		s.traceID, s.parentSpanID, s.sampled = parent.traceID, parent.spanID, parent.sampled
+		s.kind = spanKindInternal
+	} else if traceID, parentSpanID, sampled, ok := parseTraceparent(traceparent); ok {
+		s.traceID, s.parentSpanID, s.sampled = traceID, parentSpanID, sampled
+	} else {
+		s.traceID = randomHex(16)
+	}
+
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+// finish ends the span, with the HTTP status it was answered with, and hands
+// it to the exporter if there is one.
+func (s *span) finish(status int) {
+	s.end = time.Now()
+	s.status = status
+	if exporter != nil && s.sampled {
+		exporter.add(s)
+	}
+}
+
+// setSpanAttribute sets an attribute on the span in ctx, if any.
+func setSpanAttribute(ctx context.Context, key, value string) {
+	if s, ok := ctx.Value(spanKey).(*span); ok {
+		s.mutex.Lock()
+		s.attributes[key] = value
+		s.mutex.Unlock()
+	}
+}
+
+// withTracing runs every request to next in a span of the trace given by its
+// traceparent header, which is named after route.
+func withTracing(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ctx, s := startSpan(request.Context(), request.Method+" "+route, request.Header.Get("traceparent"))
+		recorder := &statusRecorder{ResponseWriter: writer, status: 200}
+		next(recorder, request.WithContext(ctx))
+		s.finish(recorder.status)
+	}
+}
+
+// statusRecorder remembers the status a response was written with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func randomHex(n int) string {
+	bytes := make([]byte, n)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// exporter sends finished spans to OTEL_EXPORTER_OTLP_ENDPOINT, if set.
+var exporter *spanExporter
+
+// spanExporter sends spans in batches, every few seconds or once enough have
+// piled up. Spans are dropped rather than slowing down requests if the
+// collector can not keep up.
+type spanExporter struct {
+	url         string
+	serviceName string
+	spans       chan *span
+	done        chan struct{}
+
+	// mutex guards closing spans, which handlers that outlive the shutdown
+	// timeout may still be adding to, and closed is set once it has been
+	// closed.
+	mutex  sync.RWMutex
+	closed bool
+}
+
+func newSpanExporter(url, serviceName string) *spanExporter {
+	e := &spanExporter{
+		url:         url,
+		serviceName: serviceName,
+		spans:       make(chan *span, 1024),
+		done:        make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// add queues a finished span to be sent, unless the exporter has stopped.
+func (e *spanExporter) add(s *span) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	if e.closed {
+		return
+	}
+
+	select {
+	case e.spans <- s:
+	default:
+	}
+}
+
+func (e *spanExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case s, ok := <-e.spans:
+			if !ok {
+				e.send(batch)
+				return
+			}
+			if batch = append(batch, s); len(batch) >= 256 {
+				e.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = nil
+		}
+	}
+}
+
+// stop sends the spans that have not been sent yet, waiting until ctx is done
+// at most.
+func (e *spanExporter) stop(ctx context.Context) error {
+	e.mutex.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.spans)
+	}
+	e.mutex.Unlock()
+
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *spanExporter) send(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := postSpans(e.url, e.serviceName, batch); err != nil {
+		logger.Warn("Error exporting spans", "spans", len(batch), "error", err)
+	}
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// postSpans sends spans to url in the OTLP/HTTP JSON encoding.
+func postSpans(url, serviceName string, spans []*span) error {
+	var encoded []map[string]interface{}
+	for _, s := range spans {
+		s.mutex.Lock()
+		attributes := []otlpAttribute{{"http.response.status_code", map[string]interface{}{"intValue": strconv.Itoa(s.status)}}}
+		for key, value := range s.attributes {
+			attributes = append(attributes, otlpAttribute{key, map[string]interface{}{"stringValue": value}})
+		}
+		s.mutex.Unlock()
+
+		encodedSpan := map[string]interface{}{
+			"traceId":           s.traceID,
+			"spanId":            s.spanID,
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attributes,
+		}
+		if s.parentSpanID != "" {
+			encodedSpan["parentSpanId"] = s.parentSpanID
+		}
+		if s.status >= 500 {
+			encodedSpan["status"] = map[string]interface{}{"code": 2} // STATUS_CODE_ERROR
+		}
+		encoded = append(encoded, encodedSpan)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{{"service.name", map[string]interface{}{"stringValue": serviceName}}},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "toot-relay"},
+				"spans": encoded,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("Collector returned %v", response.Status))
+	}
+
+	return nil
+}
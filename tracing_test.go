@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{testTraceparent, true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false, false},
+		{"", false, false},
+	}
+
+	for _, test := range tests {
+		traceID, parentSpanID, sampled, ok := parseTraceparent(test.header)
+		if ok != test.ok || sampled != test.sampled {
+			t.Errorf("%q: got ok %v and sampled %v, want %v and %v", test.header, ok, sampled, test.ok, test.sampled)
+		}
+		if ok && (traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || parentSpanID != "00f067aa0ba902b7") {
+			t.Errorf("%q: got trace ID %q and parent span ID %q", test.header, traceID, parentSpanID)
+		}
+	}
+}
+
+func TestStartSpan(t *testing.T) {
+	ctx, root := startSpan(context.Background(), "POST /relay-to", testTraceparent)
+	if root.traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || root.parentSpanID != "00f067aa0ba902b7" || root.kind != spanKindServer {
+		t.Errorf("got span %+v, want a server span of the sender's trace", root)
+	}
+
+	_, child := startSpan(ctx, "relay batch item", "")
+	if child.traceID != root.traceID || child.parentSpanID != root.spanID || child.kind != spanKindInternal {
+		t.Errorf("got span %+v, want an internal child of %s", child, root.spanID)
+	}
+
+	_, fresh := startSpan(context.Background(), "POST /relay-to", "invalid")
+	if len(fresh.traceID) != 32 || fresh.parentSpanID != "" || !fresh.sampled {
+		t.Errorf("got span %+v, want the sampled root of a new trace", fresh)
+	}
+}
+
+func TestWithTracing(t *testing.T) {
+	var s *span
+	handler := withTracing("/relay-to/{environment}/{token}", func(writer http.ResponseWriter, request *http.Request) {
+		s = request.Context().Value(spanKey).(*span)
+		setSpanAttribute(request.Context(), "apns_id", "8f7e2c1a-4b3d-4e5f-9a8b-7c6d5e4f3a2b")
+		writer.WriteHeader(410)
+	})
+
+	request := httptest.NewRequest("POST", "/relay-to/production/"+testDeviceToken, nil)
+	request.Header.Set("traceparent", testTraceparent)
+	handler(httptest.NewRecorder(), request)
+
+	if s.name != "POST /relay-to/{environment}/{token}" || s.status != 410 || s.end.IsZero() {
+		t.Errorf("got span %q with status %d ending at %v", s.name, s.status, s.end)
+	}
+	if s.attributes["apns_id"] != "8f7e2c1a-4b3d-4e5f-9a8b-7c6d5e4f3a2b" {
+		t.Errorf("got attributes %v", s.attributes)
+	}
+}
+
+func TestPostSpans(t *testing.T) {
+	var body []byte
+	collector := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ = io.ReadAll(request.Body)
+	}))
+	defer collector.Close()
+
+	_, s := startSpan(context.Background(), "POST /relay-to", testTraceparent)
+	s.finish(502)
+	if err := postSpans(collector.URL, "toot-relay-test", []*span{s}); err != nil {
+		t.Fatal(err)
+	}
+
+	var exported struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Status       struct {
+						Code int `json:"code"`
+					} `json:"status"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(body, &exported); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(exported.ResourceSpans) != 1 || len(exported.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("got %s", body)
+	}
+	spans := exported.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 || spans[0].TraceID != s.traceID || spans[0].ParentSpanID != s.parentSpanID || spans[0].Status.Code != 2 {
+		t.Errorf("got spans %+v", spans)
+	}
+}
+
+func TestSpanExporterStop(t *testing.T) {
+	var exported int
+	collector := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		exported++
+	}))
+	defer collector.Close()
+
+	e := newSpanExporter(collector.URL, "toot-relay-test")
+	_, s := startSpan(context.Background(), "POST /relay-to", testTraceparent)
+	s.finish(201)
+	e.add(s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := e.stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if exported != 1 {
+		t.Errorf("got %d exports on stopping, want the span sent", exported)
+	}
+
+	// Handlers still running after shutdown finish their spans too, which
+	// must not panic once the exporter has stopped.
+	e.add(s)
+	if err := e.stop(ctx); err != nil {
+		t.Error(err)
+	}
+}
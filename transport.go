@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The push types for the apns-push-type header.
+const (
+	pushTypeAlert      = "alert"
+	pushTypeBackground = "background"
+)
+
+// apnsTransport handles the headers that the vendored apns2 does not know
+// about. It sets apns-push-type from the string stored under pushTypeKey in
+// the request context, and stores the Retry-After header of the response in
+// the *time.Duration stored under retryAfterKey. Pushes over an existing
+// connection are counted in apnsConnectionsTotal.
+type apnsTransport struct {
+	http.RoundTripper
+}
+
+func (t apnsTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	ctx := request.Context()
+
+	request = request.Clone(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				apnsConnectionsTotal.inc("reuse")
+			}
+		},
+	}))
+	if pushType, ok := ctx.Value(pushTypeKey).(string); ok {
+		request.Header.Set("apns-push-type", pushType)
+	}
+
+	response, err := t.RoundTripper.RoundTrip(request)
+	if err != nil {
+		return response, err
+	}
+
+	if retryAfter, ok := ctx.Value(retryAfterKey).(*time.Duration); ok {
+		if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			*retryAfter = time.Duration(seconds) * time.Second
+		}
+	}
+
+	return response, nil
+}
+
+// CloseIdleConnections is needed by apns2.Client.CloseIdleConnections.
+func (t apnsTransport) CloseIdleConnections() {
+	if closer, ok := t.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// countingDialTLS wraps the dial function of an APNs client's transport, to
+// count the connections it makes and when they are closed in
+// apnsConnectionsTotal. Connection drops show up as bursts of both.
+func countingDialTLS(dial func(network, addr string, config *tls.Config) (net.Conn, error)) func(network, addr string, config *tls.Config) (net.Conn, error) {
+	return func(network, addr string, config *tls.Config) (net.Conn, error) {
+		conn, err := dial(network, addr, config)
+		if err != nil {
+			return nil, err
+		}
+
+		apnsConnectionsTotal.inc("dial")
+		return &countedConn{Conn: conn}, nil
+	}
+}
+
+type countedConn struct {
+	net.Conn
+	closed sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.closed.Do(func() { apnsConnectionsTotal.inc("close") })
+	return c.Conn.Close()
+}
+
+// ConnectionState passes on the state of TLS connections, which http2 uses
+// if available.
+func (c *countedConn) ConnectionState() tls.ConnectionState {
+	if conn, ok := c.Conn.(*tls.Conn); ok {
+		return conn.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAPNsTransport(t *testing.T) {
+	var pushType string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		pushType = request.Header.Get("apns-push-type")
+		writer.Header().Set("Retry-After", "120")
+		writer.WriteHeader(429)
+	}))
+	defer server.Close()
+
+	var retryAfter time.Duration
+	ctx := context.WithValue(context.Background(), pushTypeKey, pushTypeBackground)
+	ctx = context.WithValue(ctx, retryAfterKey, &retryAfter)
+	request, _ := http.NewRequestWithContext(ctx, "POST", server.URL, nil)
+
+	response, err := apnsTransport{http.DefaultTransport}.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if pushType != pushTypeBackground {
+		t.Errorf("got apns-push-type %q, want background", pushType)
+	}
+	if retryAfter != 2*time.Minute {
+		t.Errorf("got Retry-After %v, want 2m", retryAfter)
+	}
+}
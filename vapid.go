@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// withVAPID only lets requests through to next if they carry a valid VAPID
+// (RFC 8292) token signed by one of allowedKeys, which are base64url encoded
+// public keys. The token must be for audience, or the origin of the request if
+// that is empty.
+func withVAPID(allowedKeys []string, audience string, next http.HandlerFunc) http.HandlerFunc {
+	allowed := make(map[string]bool)
+	for _, key := range allowedKeys {
+		if decoded, err := decodeBase64URL(strings.TrimSpace(key)); err == nil {
+			allowed[string(decoded)] = true
+		}
+	}
+
+	return func(writer http.ResponseWriter, request *http.Request) {
+		expectedAudience := audience
+		if expectedAudience == "" {
+			expectedAudience = "https://" + request.Host
+		}
+
+		err := verifyVAPID(request, expectedAudience, allowed)
+		if err != nil {
+			writer.WriteHeader(401)
+			fmt.Fprintln(writer, "Invalid VAPID authorization:", err)
+			logger.WarnContext(request.Context(), "Invalid VAPID authorization", "error", err)
+			return
+		}
+
+		next(writer, request)
+	}
+}
+
+// verifyVAPID checks the token in the Authorization header.
+func verifyVAPID(request *http.Request, audience string, allowed map[string]bool) error {
+	token, key := vapidCredentials(request)
+	if token == "" || key == "" {
+		return errors.New("Missing VAPID token or key")
+	}
+
+	publicKeyBytes, err := decodeBase64URL(key)
+	if err != nil {
+		return err
+	}
+	if !allowed[string(publicKeyBytes)] {
+		return errors.New("VAPID key is not allowed")
+	}
+
+	x, y := elliptic.Unmarshal(elliptic.P256(), publicKeyBytes)
+	if x == nil {
+		return errors.New("Invalid VAPID key")
+	}
+	publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("Malformed VAPID token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return err
+	}
+	if header.Alg != "ES256" {
+		return errors.New(fmt.Sprintf("Unsupported VAPID token algorithm %q", header.Alg))
+	}
+
+	signature, err := decodeBase64URL(parts[2])
+	if err != nil || len(signature) != 64 {
+		return errors.New("Malformed VAPID token signature")
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(publicKey, hash[:], r, s) {
+		return errors.New("Invalid VAPID token signature")
+	}
+
+	var claims struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return err
+	}
+	if claims.Aud != audience {
+		return errors.New(fmt.Sprintf("VAPID token audience %q is not %q", claims.Aud, audience))
+	}
+
+	// RFC 8292 limits tokens to being valid for at most 24 hours.
+	expires := time.Unix(claims.Exp, 0)
+	if time.Now().After(expires) {
+		return errors.New("VAPID token has expired")
+	}
+	if time.Until(expires) > 24*time.Hour {
+		return errors.New("VAPID token expires more than 24 hours from now")
+	}
+
+	return nil
+}
+
+// vapidCredentials returns the VAPID token and public key that request was
+// sent with, if any. Besides the current "vapid t=...,k=..." form of the
+// Authorization header, it accepts the older "WebPush <token>" form with the
+// key in the p256ecdsa value of the Crypto-Key header.
+func vapidCredentials(request *http.Request) (token, key string) {
+	authorization := request.Header.Get("Authorization")
+	if scheme, credentials, _ := strings.Cut(authorization, " "); strings.EqualFold(scheme, "vapid") {
+		for _, parameter := range strings.Split(credentials, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(parameter), "=")
+			switch name {
+			case "t":
+				token = value
+			case "k":
+				key = value
+			}
+		}
+	} else if strings.EqualFold(scheme, "webpush") {
+		token = strings.TrimSpace(credentials)
+		key = parseKeyValues(request.Header.Get("Crypto-Key"))["p256ecdsa"]
+	}
+
+	return token, key
+}
+
+// vapidFields returns the payload fields that FORWARD_VAPID adds: the public
+// key as "v", which may also be given in the Crypto-Key header alone, and the
+// token as "a", both as they were sent.
+func vapidFields(request *http.Request) map[string]string {
+	token, key := vapidCredentials(request)
+	if key == "" {
+		key = parseKeyValues(request.Header.Get("Crypto-Key"))["p256ecdsa"]
+	}
+
+	fields := make(map[string]string)
+	if key != "" {
+		fields["v"] = key
+	}
+	if token != "" {
+		fields["a"] = token
+	}
+	return fields
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := decodeBase64URL(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// decodeBase64URL decodes base64url, with or without padding.
+func decodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	invalidationWebhookURL    string
+	invalidationWebhookSecret string
+)
+
+// invalidTokenReasons are the rejections that mean a device token will never
+// work again, so its subscription should be removed.
+var invalidTokenReasons = map[string]bool{
+	"Unregistered":           true,
+	"BadDeviceToken":         true,
+	"DeviceTokenNotForTopic": true,
+	"UNREGISTERED":           true,
+}
+
+// reportInvalidToken tells the server at INVALIDATION_WEBHOOK_URL, if set,
+// that a device token was rejected for good. It does so in the background,
+// retrying failed deliveries with exponential backoff.
+func reportInvalidToken(ctx context.Context, deviceToken, reason string) {
+	if invalidationWebhookURL == "" || !invalidTokenReasons[reason] {
+		return
+	}
+
+	body, _ := json.Marshal(map[string]string{
+		"token":     deviceToken,
+		"reason":    reason,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		var err error
+		for attempt := 0; attempt <= 3; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Second << uint(attempt-1))
+			}
+
+			if err = postWebhook(ctx, body); err == nil {
+				return
+			}
+		}
+
+		logger.ErrorContext(ctx, "Error delivering invalidation webhook", "device_token", redactToken(deviceToken), "error", err)
+	}()
+}
+
+func postWebhook(ctx context.Context, body []byte) error {
+	request, err := http.NewRequest("POST", invalidationWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+
+	if invalidationWebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(invalidationWebhookSecret))
+		mac.Write(body)
+		request.Header.Set("X-Relay-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("Webhook returned %v", response.Status))
+	}
+
+	return nil
+}
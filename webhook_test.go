@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sideshow/apns2"
+)
+
+type webhookCall struct {
+	body      []byte
+	signature string
+}
+
+// useWebhook points INVALIDATION_WEBHOOK_URL at a server answering with
+// status, and returns the calls it receives.
+func useWebhook(t *testing.T, secret string, status int) <-chan webhookCall {
+	calls := make(chan webhookCall, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		calls <- webhookCall{body, request.Header.Get("X-Relay-Signature")}
+		writer.WriteHeader(status)
+	}))
+
+	invalidationWebhookURL, invalidationWebhookSecret = server.URL, secret
+	t.Cleanup(func() {
+		invalidationWebhookURL, invalidationWebhookSecret = "", ""
+		server.Close()
+	})
+	return calls
+}
+
+func TestHandlerInvalidationWebhook(t *testing.T) {
+	calls := useWebhook(t, "webhook secret", 204)
+
+	pusher := &fakePusher{respond: func(*apns2.Notification) (*apns2.Response, error) {
+		return &apns2.Response{StatusCode: 410, Reason: apns2.ReasonUnregistered}, nil
+	}}
+	if response := post(newTestRelay(pusher), relayRequest(testDeviceToken, []byte("message"), aesgcmHeaders())); response.Code != 410 {
+		t.Fatalf("got status %d, want 410", response.Code)
+	}
+
+	var call webhookCall
+	select {
+	case call = <-calls:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not called")
+	}
+
+	var body map[string]string
+	if err := json.Unmarshal(call.body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["token"] != testDeviceToken || body["reason"] != apns2.ReasonUnregistered || body["timestamp"] == "" {
+		t.Errorf("got webhook body %v", body)
+	}
+
+	mac := hmac.New(sha256.New, []byte("webhook secret"))
+	mac.Write(call.body)
+	if want := hex.EncodeToString(mac.Sum(nil)); call.signature != want {
+		t.Errorf("got signature %q, want %q", call.signature, want)
+	}
+}
+
+func TestInvalidationWebhookReasons(t *testing.T) {
+	calls := useWebhook(t, "", 204)
+
+	// Rejections that do not invalidate the token are not reported.
+	reportInvalidToken(context.Background(), testDeviceToken, apns2.ReasonPayloadTooLarge)
+	reportInvalidToken(context.Background(), testDeviceToken, apns2.ReasonDeviceTokenNotForTopic)
+
+	select {
+	case call := <-calls:
+		if call.signature != "" {
+			t.Errorf("got signature %q without a secret", call.signature)
+		}
+		var body map[string]string
+		json.Unmarshal(call.body, &body)
+		if body["reason"] != apns2.ReasonDeviceTokenNotForTopic {
+			t.Errorf("got reason %q, want %s", body["reason"], apns2.ReasonDeviceTokenNotForTopic)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not called")
+	}
+
+	select {
+	case call := <-calls:
+		t.Errorf("webhook called again with %s", call.body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPostWebhookError(t *testing.T) {
+	useWebhook(t, "", 500)
+	if err := postWebhook(context.Background(), []byte("{}")); err == nil {
+		t.Error("got no error for a 500 response")
+	}
+}